@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Loads the user and checks its password. Plaintext passwords and outdated
+// hashes are replaced by a current hash along the way.
+func (m *Manager) authenticate(username string, password Secret) (User, error) {
+	user, err := m.LoadUser(username)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			return User{}, ErrInvalidCredentials
+		}
+		return User{}, err
+	}
+	ok, needsRehash, err := user.checkPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	if !ok {
+		return User{}, ErrInvalidCredentials
+	}
+
+	if needsRehash {
+		// Plaintext accounts predate roles, back then every account could do everything
+		if user.PasswordHash == "" && user.Role == "" {
+			user.Role = RoleAdmin
+		}
+		// The login works either way, the next one will try again
+		if err := user.setPassword(password); err != nil {
+			slog.Error("could not hash password", "user", user, "err", err)
+		} else if err := m.store.SaveUser(*m.ctx, user); err != nil {
+			slog.Error("could not save rehashed password", "user", user, "err", err)
+			countError("authenticate", "rehash")
+		} else {
+			slog.Info("rehashed password", "user", user)
+		}
+	}
+	return user, nil
+}
+
+// Limits password checks per client address and, if given, per username, since
+// each of them takes a lot of memory and cpu (see argonParams)
+func (m *Manager) takeAuthLimit(r *http.Request, username string) (bool, time.Duration) {
+	rate, burst := float64(m.config.Auth.AttemptsPerMinute)/60, m.config.Auth.AttemptBurst
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ok, wait := m.rateLimits.take("auth_addr:"+host, rate, burst, 1); !ok || username == "" {
+		return ok, wait
+	}
+	return m.rateLimits.take("auth_user:"+username, rate, burst, 1)
+}
+
+func RegisterHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	w.Header().Set("Content-Type", "text/plain")
+	logger := loggerFrom(r.Context())
+	if !m.config.AllowRegistration {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Registration is disabled")
+		return
+	}
+
+	var creds Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		countError("RegisterHandler", "decode")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid request")
+		return
+	}
+	if err := validateCredentials(creds.Username, creds.Password); err != nil {
+		countError("RegisterHandler", "invalid")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if ok, wait := m.takeAuthLimit(r, creds.Username); !ok {
+		countError("RegisterHandler", "rate_limited")
+		writeRateLimited(w, wait)
+		return
+	}
+
+	user := User{Username: creds.Username, Role: defaultRole}
+	if err := user.setPassword(creds.Password); err != nil {
+		logger.Error("could not hash password", "err", err)
+		countError("RegisterHandler", "hash")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := m.store.CreateUser(*m.ctx, user); err != nil {
+		if errors.Is(err, ErrUserExists) {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, "Username is taken")
+			return
+		}
+		logger.Error("could not create user", "user", user, "err", err)
+		countError("RegisterHandler", "create")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Info("registered user", "user", user)
+	w.WriteHeader(http.StatusCreated)
+}
+
+type PasswordChange struct {
+	Username        string `json:"username"`
+	CurrentPassword Secret `json:"currentPassword"`
+	NewPassword     Secret `json:"newPassword"`
+}
+
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	w.Header().Set("Content-Type", "text/plain")
+	logger := loggerFrom(r.Context())
+
+	var change PasswordChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		countError("ChangePasswordHandler", "decode")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid request")
+		return
+	}
+	if err := validateCredentials(change.Username, change.NewPassword); err != nil {
+		countError("ChangePasswordHandler", "invalid")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if ok, wait := m.takeAuthLimit(r, change.Username); !ok {
+		countError("ChangePasswordHandler", "rate_limited")
+		writeRateLimited(w, wait)
+		return
+	}
+
+	user, err := m.authenticate(change.Username, change.CurrentPassword)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			countError("ChangePasswordHandler", "invalid_credentials")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "Invalid credentials")
+			return
+		}
+		logger.Error("could not authenticate user", "err", err)
+		countError("ChangePasswordHandler", "load_user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := user.changePassword(change.NewPassword); err != nil {
+		logger.Error("could not hash password", "err", err)
+		countError("ChangePasswordHandler", "hash")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := m.store.SaveUser(*m.ctx, user); err != nil {
+		logger.Error("could not save user", "user", user, "err", err)
+		countError("ChangePasswordHandler", "save")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Info("changed password", "user", user)
+}
+
+type RoleChange struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+func SetRoleHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	logger := loggerFrom(r.Context())
+
+	var change RoleChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		countError("SetRoleHandler", "decode")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid request")
+		return
+	}
+	role, err := parseRole(change.Role)
+	if err != nil {
+		countError("SetRoleHandler", "invalid")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	// Keeps admins from locking themselves out
+	if claims, ok := claimsFrom(r.Context()); ok && claims.Username == change.Username {
+		countError("SetRoleHandler", "own_role")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Can't change your own role")
+		return
+	}
+
+	user, err := m.LoadUser(change.Username)
+	if err != nil {
+		if errors.Is(err, ErrUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Unknown user")
+			return
+		}
+		logger.Error("could not load user", "err", err)
+		countError("SetRoleHandler", "load_user")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	user.Role = role
+	if err := m.store.SaveUser(*m.ctx, user); err != nil {
+		logger.Error("could not save user", "user", user, "err", err)
+		countError("SetRoleHandler", "save")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Info("changed role", "user", user)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// Logs in a freshly created user with the role
+func (srv *testServer) login(t *testing.T, username string, role Role) string {
+	t.Helper()
+	user := User{Username: username, Role: role}
+	user.setPassword("password of " + Secret(username))
+	srv.manager.store.SaveUser(context.Background(), user)
+	return srv.tokens(t, username, "password of "+Secret(username)).AccessToken
+}
+
+func (srv *testServer) tokens(t *testing.T, username string, password Secret) TokenPair {
+	t.Helper()
+	status, body := srv.post(t, "/auth", "", Credentials{username, password})
+	if status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+	var tokens TokenPair
+	if err := json.Unmarshal([]byte(body), &tokens); err != nil {
+		t.Fatalf("could not decode tokens: %v", err)
+	}
+	return tokens
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowRegistration = true
+	srv := newTestServerWithConfig(t, cfg)
+
+	creds := Credentials{"painter", "correct horse battery"}
+	if status, body := srv.post(t, "/register", "", creds); status != http.StatusCreated {
+		t.Fatalf("register: got %d %q", status, body)
+	}
+	if status, _ := srv.post(t, "/register", "", creds); status != http.StatusConflict {
+		t.Errorf("registering twice: got %d, want %d", status, http.StatusConflict)
+	}
+	if status, _ := srv.post(t, "/register", "", Credentials{"other", "short"}); status != http.StatusBadRequest {
+		t.Errorf("short password: got %d, want %d", status, http.StatusBadRequest)
+	}
+
+	user, _ := srv.manager.LoadUser("painter")
+	if user.PasswordHash == "" || user.Password != "" {
+		t.Errorf("password isn't hashed: %+v", user)
+	}
+	if tokens := srv.tokens(t, creds.Username, creds.Password); tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Errorf("login: got %+v", tokens)
+	}
+	if status, _ := srv.post(t, "/auth", "", Credentials{"painter", "wrong password"}); status != http.StatusUnauthorized {
+		t.Errorf("wrong password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRegistrationCanBeDisabled(t *testing.T) {
+	srv := newTestServer(t)
+	if status, _ := srv.post(t, "/register", "", Credentials{"painter", "correct horse battery"}); status != http.StatusForbidden {
+		t.Errorf("got %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestPlaintextPasswordIsMigratedOnLogin(t *testing.T) {
+	srv := newTestServer(t)
+	srv.manager.store.SaveUser(context.Background(), User{Username: "old", Password: "plaintext"})
+
+	if status, _ := srv.post(t, "/auth", "", Credentials{"old", "plaintext"}); status != http.StatusOK {
+		t.Fatalf("login: got %d", status)
+	}
+	user, _ := srv.manager.LoadUser("old")
+	if user.Password != "" {
+		t.Errorf("plaintext password is still stored")
+	}
+	if ok, _, err := user.checkPassword("plaintext"); !ok || err != nil {
+		t.Errorf("migrated hash doesn't match: %v", err)
+	}
+	if user.Role != RoleAdmin {
+		t.Errorf("legacy account got role %q, want admin", user.Role)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	srv := newTestServer(t)
+	user := User{Username: "admin"}
+	user.setPassword("old password")
+	srv.manager.store.SaveUser(context.Background(), user)
+	stolen := srv.tokens(t, "admin", "old password").RefreshToken
+
+	change := PasswordChange{"admin", "wrong password", "new password"}
+	if status, _ := srv.post(t, "/change-password", "", change); status != http.StatusUnauthorized {
+		t.Errorf("wrong current password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	change.CurrentPassword = "old password"
+	if status, body := srv.post(t, "/change-password", "", change); status != http.StatusOK {
+		t.Fatalf("got %d %q", status, body)
+	}
+	if status, _ := srv.post(t, "/auth", "", Credentials{"admin", "new password"}); status != http.StatusOK {
+		t.Errorf("login with new password: got %d", status)
+	}
+	if status, _ := srv.post(t, "/auth", "", Credentials{"admin", "old password"}); status != http.StatusUnauthorized {
+		t.Errorf("login with old password: got %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	// Logins from before the change can't be kept alive
+	if status, _ := srv.post(t, "/refresh", "", RefreshRequest{stolen}); status != http.StatusUnauthorized {
+		t.Errorf("refresh token from before the change: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	current := srv.tokens(t, "admin", "new password").RefreshToken
+	if status, body := srv.post(t, "/refresh", "", RefreshRequest{current}); status != http.StatusOK {
+		t.Errorf("refresh token from after the change: got %d %q", status, body)
+	}
+}
+
+func TestLoginAttemptsAreRateLimited(t *testing.T) {
+	cfg := testConfig()
+	cfg.Auth.AttemptsPerMinute, cfg.Auth.AttemptBurst = 1, 3
+	srv := newTestServerWithConfig(t, cfg)
+
+	for i := range 3 {
+		if status, _ := srv.post(t, "/auth", "", Credentials{"victim", "wrong password"}); status != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: got %d, want %d", i, status, http.StatusUnauthorized)
+		}
+	}
+	res, _ := srv.request(t, http.MethodPost, "/auth", "", Credentials{"victim", "wrong password"})
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Errorf("got %d with Retry-After %q, want %d", res.StatusCode, res.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	// The same address can't just move on to the next user
+	change := PasswordChange{"other", "wrong password", "long enough password"}
+	if status, _ := srv.post(t, "/change-password", "", change); status != http.StatusTooManyRequests {
+		t.Errorf("change password: got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestPermissionsPerRole(t *testing.T) {
+	srv := newTestServer(t)
+	colors := map[string]any{"colors": []string{"#ffffff", "#000000"}, "bitsPerColor": 6, "defaultColor": "#ffffff"}
+	tokens := map[Role]string{}
+	for _, role := range []Role{RoleViewer, RolePainter, RoleModerator, RoleAdmin} {
+		tokens[role] = srv.login(t, string(role), role)
+	}
+
+	for _, tc := range []struct {
+		path    string
+		payload any
+		allowed Role
+	}{
+		{"/delete-pos-id?pos=unknown", nil, RoleModerator},
+		{"/load-img", ImgLoadInstructions{Path: "/nonexistent.png"}, RoleAdmin},
+		{"/user-role", RoleChange{"viewer", "viewer"}, RoleAdmin},
+		{"/update-colors", colors, RoleAdmin},
+	} {
+		for role, token := range tokens {
+			status, _ := srv.post(t, tc.path, token, tc.payload)
+			mayAccess := role == tc.allowed || role == RoleAdmin
+			if forbidden := status == http.StatusForbidden; forbidden == mayAccess {
+				t.Errorf("%s as %s: got status %d", tc.path, role, status)
+			}
+		}
+	}
+	if status, _ := srv.post(t, "/update-colors", "", colors); status != http.StatusUnauthorized {
+		t.Errorf("without token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRoleChangeAppliesOnNextLogin(t *testing.T) {
+	srv := newTestServer(t)
+	admin := srv.login(t, "admin", RoleAdmin)
+	srv.login(t, "mod", RolePainter)
+
+	if status, body := srv.post(t, "/user-role", admin, RoleChange{"mod", "moderator"}); status != http.StatusOK {
+		t.Fatalf("got %d %q", status, body)
+	}
+	if status, _ := srv.post(t, "/user-role", admin, RoleChange{"mod", "overlord"}); status != http.StatusBadRequest {
+		t.Errorf("unknown role: got %d, want %d", status, http.StatusBadRequest)
+	}
+	token := srv.tokens(t, "mod", "password of mod").AccessToken
+	if status, _ := srv.post(t, "/delete-pos-id?pos=unknown", token, nil); status != http.StatusOK {
+		t.Errorf("moderator can't delete positions: got %d", status)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Long-lived credentials for scripts and bots, created and revoked by admins.
+// Their value looks like bpx_<id>_<secret>, only a hash of it is stored.
+type APIKey struct {
+	Id     string       `json:"id"`
+	Name   string       `json:"name"`
+	Hash   string       `json:"hash,omitempty"`
+	Scopes []Permission `json:"scopes"`
+	// Where the key may set pixels, the whole canvas if nil
+	Area *Area `json:"area,omitempty"`
+	// Requests (and pixels set over the websocket) per second, with bursts of up to Burst
+	RateLimit float64   `json:"rateLimit"`
+	Burst     int       `json:"burst"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (k *APIKey) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("id", k.Id), slog.String("name", k.Name))
+}
+
+// What API keys can be allowed to do, everything else needs a user
+var apiKeyScopes = []Permission{PermRead, PermPlace, PermLoadImage}
+
+const (
+	apiKeyPrefix           = "bpx_"
+	defaultAPIKeyRateLimit = 10
+	defaultAPIKeyBurst     = 20
+)
+
+func (k *APIKey) Can(perm Permission) bool {
+	return slices.Contains(k.Scopes, perm)
+}
+
+// Whether the key may change the pixels of rect
+func (k *APIKey) allowsArea(rect Area) bool {
+	return k.Area == nil || k.Area.containsArea(rect)
+}
+
+// Rectangle of the canvas, BotRight is exclusive like for sections
+type Area struct {
+	TopLeft  Point `json:"topLeft"`
+	BotRight Point `json:"botRight"`
+}
+
+func (a Area) empty() bool {
+	return a.BotRight.X <= a.TopLeft.X || a.BotRight.Y <= a.TopLeft.Y
+}
+
+func (a Area) contains(x, y int) bool {
+	return x >= a.TopLeft.X && x < a.BotRight.X && y >= a.TopLeft.Y && y < a.BotRight.Y
+}
+
+func (a Area) containsArea(b Area) bool {
+	return b.TopLeft.X >= a.TopLeft.X && b.TopLeft.Y >= a.TopLeft.Y &&
+		b.BotRight.X <= a.BotRight.X && b.BotRight.Y <= a.BotRight.Y
+}
+
+func isAPIKey(value string) bool {
+	return strings.HasPrefix(value, apiKeyPrefix)
+}
+
+// Returns the id of the key a value claims to belong to
+func apiKeyId(value string) (string, bool) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(value, apiKeyPrefix), "_")
+	return id, ok && id != ""
+}
+
+func newAPIKeyValue(id string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Returns ErrInvalidToken if the value doesn't belong to an existing key
+func (m *Manager) verifyAPIKey(value string) (*APIKey, error) {
+	id, ok := apiKeyId(value)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	key, err := m.store.APIKey(*m.ctx, id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashToken(value))) != 1 {
+		return nil, ErrInvalidToken
+	}
+	return &key, nil
+}
+
+// Takes n requests (or pixels) from the key's rate limit, returns how long to wait otherwise
+func (m *Manager) takeAPIKeyLimit(key *APIKey, n int) (bool, time.Duration) {
+	return m.rateLimits.take("api_key:"+key.Id, key.RateLimit, key.Burst, n)
+}
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprint(w, "Rate limit exceeded")
+}
+
+func withAPIKey(ctx context.Context, key *APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey, key)
+}
+
+// The key an authorized request was made with, if it wasn't made by a user
+func apiKeyFrom(ctx context.Context) (*APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey).(*APIKey)
+	return key, ok
+}
+
+type APIKeyRequest struct {
+	Name      string       `json:"name"`
+	Scopes    []Permission `json:"scopes"`
+	Area      *Area        `json:"area,omitempty"`
+	RateLimit float64      `json:"rateLimit"`
+	Burst     int          `json:"burst"`
+}
+
+func (req *APIKeyRequest) validate() error {
+	if req.Name == "" || len(req.Name) > 64 {
+		return errors.New("names need 1 to 64 characters")
+	}
+	if len(req.Scopes) == 0 {
+		return errors.New("at least one scope is needed")
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return fmt.Errorf("unknown scope %q (expected read, place or load_image)", scope)
+		}
+	}
+	if req.Area != nil && req.Area.empty() {
+		return errors.New("empty area")
+	}
+	if req.RateLimit < 0 || req.Burst < 0 {
+		return errors.New("negative rate limit")
+	}
+	return nil
+}
+
+// What the admin gets back once, the key can't be shown again
+type CreatedAPIKey struct {
+	Key    string `json:"key"`
+	APIKey APIKey `json:"apiKey"`
+}
+
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	logger := loggerFrom(r.Context())
+
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		countError("CreateAPIKeyHandler", "decode")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid request")
+		return
+	}
+	if err := req.validate(); err != nil {
+		countError("CreateAPIKeyHandler", "invalid")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	if req.RateLimit == 0 {
+		req.RateLimit = defaultAPIKeyRateLimit
+	}
+	if req.Burst == 0 {
+		req.Burst = max(defaultAPIKeyBurst, int(req.RateLimit))
+	}
+
+	claims, _ := claimsFrom(r.Context())
+	key := APIKey{
+		Id:        newId(),
+		Name:      req.Name,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		Area:      req.Area,
+		RateLimit: req.RateLimit,
+		Burst:     req.Burst,
+		CreatedBy: claims.Username,
+		CreatedAt: time.Now().UTC(),
+	}
+	value, err := newAPIKeyValue(key.Id)
+	if err != nil {
+		logger.Error("could not create api key", "err", err)
+		countError("CreateAPIKeyHandler", "create")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	key.Hash = hashToken(value)
+	if err := m.store.SaveAPIKey(*m.ctx, key); err != nil {
+		logger.Error("could not save api key", "err", err)
+		countError("CreateAPIKeyHandler", "save")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	logger.Info("created api key", "apiKey", &key, "scopes", key.Scopes)
+
+	key.Hash = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreatedAPIKey{value, key})
+}
+
+func ListAPIKeysHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	keys, err := m.store.APIKeys(*m.ctx)
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not load api keys", "err", err)
+		countError("ListAPIKeysHandler", "load")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for i := range keys {
+		keys[i].Hash = ""
+	}
+	slices.SortFunc(keys, func(a, b APIKey) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	logger := loggerFrom(r.Context())
+	id := mux.Vars(r)["id"]
+	if err := m.store.DeleteAPIKey(*m.ctx, id); err != nil {
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "Unknown API key")
+			return
+		}
+		logger.Error("could not delete api key", "id", id, "err", err)
+		countError("RevokeAPIKeyHandler", "delete")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	m.rateLimits.remove("api_key:" + id)
+	m.disconnectAPIKey(id)
+	logger.Info("revoked api key", "id", id)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func (srv *testServer) createAPIKey(t *testing.T, admin string, req APIKeyRequest) CreatedAPIKey {
+	t.Helper()
+	status, body := srv.post(t, "/api-keys", admin, req)
+	if status != http.StatusCreated {
+		t.Fatalf("create api key: got %d %q", status, body)
+	}
+	var created CreatedAPIKey
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	return created
+}
+
+func TestAPIKeyScopesAndArea(t *testing.T) {
+	srv := newTestServer(t)
+	admin := srv.login(t, "admin", RoleAdmin)
+	created := srv.createAPIKey(t, admin, APIKeyRequest{
+		Name:   "bot",
+		Scopes: []Permission{PermLoadImage},
+		Area:   &Area{Point{10, 10}, Point{30, 30}},
+	})
+	if !strings.HasPrefix(created.Key, apiKeyPrefix+created.APIKey.Id+"_") || created.APIKey.Hash != "" {
+		t.Fatalf("unexpected key: %+v", created)
+	}
+	key := created.Key
+
+	if status, _ := srv.post(t, "/update-colors", key, nil); status != http.StatusForbidden {
+		t.Errorf("out of scope: got %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := srv.post(t, "/api-keys", key, APIKeyRequest{Name: "mine", Scopes: []Permission{PermRead}}); status != http.StatusForbidden {
+		t.Errorf("keys creating keys: got %d, want %d", status, http.StatusForbidden)
+	}
+	img := testPNG(t, 10, 10)
+	if res, _ := srv.uploadImage(t, key, "x=25&y=10", img); res.StatusCode != http.StatusForbidden {
+		t.Errorf("outside the area: got %d, want %d", res.StatusCode, http.StatusForbidden)
+	}
+
+	// Also accepted in its own header
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/load-img?x=20&y=20", bytes.NewReader(img))
+	req.Header.Set("X-API-Key", key)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("inside the area: got %d", res.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodDelete, srv.URL+"/api-keys/"+created.APIKey.Id, nil)
+	req.Header.Set("Authorization", "Bearer "+admin)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("revoke: %v %v", res, err)
+	}
+	if res, _ := srv.uploadImage(t, key, "x=20&y=20", img); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked key: got %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+	srv := newTestServer(t)
+	admin := srv.login(t, "admin", RoleAdmin)
+	key := srv.createAPIKey(t, admin, APIKeyRequest{Name: "slow", Scopes: []Permission{PermRead}, RateLimit: 0.1, Burst: 2}).Key
+
+	for i := range 2 {
+		if status, _ := srv.post(t, "/logout", key, nil); status == http.StatusTooManyRequests {
+			t.Fatalf("request %d was rate limited", i)
+		}
+	}
+	if status, _ := srv.post(t, "/logout", key, nil); status != http.StatusTooManyRequests {
+		t.Errorf("got %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestAPIKeyOnWebsocket(t *testing.T) {
+	srv := newTestServer(t)
+	admin := srv.login(t, "admin", RoleAdmin)
+	section, _ := srv.manager.canvas().section("0")
+	topLeft := section.meta.TopLeft
+	key := srv.createAPIKey(t, admin, APIKeyRequest{
+		Name:   "painter",
+		Scopes: []Permission{PermRead, PermPlace},
+		Area:   &Area{topLeft, Point{topLeft.X + 10, topLeft.Y + 1}},
+	}).Key
+
+	if _, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?api_key=bpx_nope_nope", nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("invalid key: got %v, want %d", err, http.StatusUnauthorized)
+	}
+
+	c := srv.dialQuery(t, "api_key="+key)
+	c.subscribe("0")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("0") == 1 })
+
+	inside := SetPixelData{SecId: "0", PixIdx: 9, ColorId: 3}
+	c.setPixel(inside)
+	c.expectPixel(inside)
+	c.setPixel(SetPixelData{SecId: "0", PixIdx: 10, ColorId: 3})
+	c.expectSilence()
+}
@@ -0,0 +1,92 @@
+package main
+
+// Layout of the canvas: its sections, palette and named positions. A Canvas is
+// never modified once it's published, changes swap in an updated copy. That
+// way request handlers and the event loop can read it without taking a lock.
+type Canvas struct {
+	sections      []*Section
+	colorProvider *ColorProvider
+	positions     map[string]PositionInfo
+}
+
+func emptyCanvas() *Canvas {
+	return &Canvas{
+		colorProvider: NewColorProvider(0),
+		positions:     make(map[string]PositionInfo),
+	}
+}
+
+func (m *Manager) canvas() *Canvas {
+	return m.canvasState.Load()
+}
+
+// Publishes a copy of the current canvas changed by update. Updates are
+// serialized, update has to replace (not modify) whatever it changes.
+func (m *Manager) updateCanvas(update func(c *Canvas)) {
+	m.canvasMu.Lock()
+	defer m.canvasMu.Unlock()
+
+	c := *m.canvas()
+	update(&c)
+	m.canvasState.Store(&c)
+}
+
+func (m *Manager) setPosition(posId string, pos PositionInfo) {
+	m.updateCanvas(func(c *Canvas) {
+		positions := make(map[string]PositionInfo, len(c.positions)+1)
+		for id, p := range c.positions {
+			positions[id] = p
+		}
+		positions[posId] = pos
+		c.positions = positions
+	})
+}
+
+func (m *Manager) removePosition(posId string) {
+	m.updateCanvas(func(c *Canvas) {
+		positions := make(map[string]PositionInfo, len(c.positions))
+		for id, p := range c.positions {
+			if id != posId {
+				positions[id] = p
+			}
+		}
+		c.positions = positions
+	})
+}
+
+func (c *Canvas) section(secId string) (*Section, bool) {
+	for _, section := range c.sections {
+		if section.meta.Id == secId {
+			return section, true
+		}
+	}
+	return nil, false
+}
+
+// The section containing the pixel at global coordinates x, y
+func (c *Canvas) sectionAt(x, y int) (*Section, bool) {
+	for _, section := range c.sections {
+		if x >= section.meta.TopLeft.X && x < section.meta.BotRight.X &&
+			y >= section.meta.TopLeft.Y && y < section.meta.BotRight.Y {
+			return section, true
+		}
+	}
+	return nil, false
+}
+
+// The sections overlapping the area
+func (c *Canvas) sectionsIn(area Area) []*Section {
+	sections := make([]*Section, 0, 4)
+	for _, section := range c.sections {
+		if section.meta.TopLeft.X < area.BotRight.X && area.TopLeft.X < section.meta.BotRight.X &&
+			section.meta.TopLeft.Y < area.BotRight.Y && area.TopLeft.Y < section.meta.BotRight.Y {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+// Index of the pixel at global coordinates x, y within its section
+func (s *Section) pixIdx(x, y int) int {
+	return (y-s.meta.TopLeft.Y)*s.Width() + (x - s.meta.TopLeft.X)
+}
@@ -2,70 +2,99 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
 // https://github.com/gorilla/websocket/blob/main/examples/chat/client.go
-var (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 20 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
-)
-
 type Client struct {
+	id                 string
+	logger             *slog.Logger
+	sessionToken       string
 	connection         *websocket.Conn
 	manager            *Manager
 	setPixEvtJson      chan []byte
 	subscribedSections map[string]struct{}
+	pending            [][]byte // written before anything else (session info, missed events)
+	writerDone         chan struct{}
+	// Credentials the client connected with, if any
+	claims *Claims
+	apiKey *APIKey
 }
 
 type ClientList map[*Client]bool
 
+// Pixels queued for a client before it counts as too slow and gets disconnected
+const clientSendBuffer = 256
+
 func NewClient(conn *websocket.Conn, m *Manager) *Client {
+	id := newId()
 	return &Client{
+		id:                 id,
+		logger:             slog.Default().With("clientId", id),
 		connection:         conn,
 		manager:            m,
-		setPixEvtJson:      make(chan []byte),
+		setPixEvtJson:      make(chan []byte, clientSendBuffer),
 		subscribedSections: make(map[string]struct{}),
+		writerDone:         make(chan struct{}),
 	}
 }
 
+// Anonymous clients get the configured anonymous role
+func (client *Client) can(perm Permission) bool {
+	switch {
+	case client.apiKey != nil:
+		return client.apiKey.Can(perm)
+	case client.claims != nil:
+		return client.claims.Role.Can(perm)
+	}
+	return client.manager.config.Auth.AnonymousRole.Can(perm)
+}
+
 func (client *Client) WriteMsgs() {
+	wsConfig := client.manager.config.Websocket
 	ch := make(chan SetPixelData)
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(wsConfig.PingPeriod())
+	// Events which were taken off the queue but couldn't be written
+	var unwritten [][]byte
 	defer func() {
 		ticker.Stop()
 		close(ch)
-		client.manager.removeClient(client)
+		client.manager.detachClient(client, unwritten, nil)
+		close(client.writerDone)
 	}()
 
+	for i, msg := range client.pending {
+		client.connection.SetWriteDeadline(time.Now().Add(wsConfig.WriteWait))
+		if err := client.connection.WriteMessage(websocket.TextMessage, msg); err != nil {
+			client.logger.Warn("could not write message to client", "err", err)
+			// The first message is the session info, the others are missed events
+			unwritten = client.pending[max(i, 1):]
+			return
+		}
+	}
+	client.pending = nil
+
 	for {
 		select {
 		case json, ok := <-client.setPixEvtJson:
-			client.connection.SetWriteDeadline(time.Now().Add(writeWait))
+			client.connection.SetWriteDeadline(time.Now().Add(wsConfig.WriteWait))
 			if !ok {
 				// Server closed the channel
 				client.connection.WriteMessage(websocket.CloseMessage, nil)
 				return
 			}
 			if err := client.connection.WriteMessage(websocket.TextMessage, json); err != nil {
-				log.Println("could not write message to client:", err)
+				client.logger.Warn("could not write message to client", "err", err)
+				unwritten = [][]byte{json}
+				return
 			}
 		case <-ticker.C:
-			client.connection.SetWriteDeadline(time.Now().Add(writeWait))
+			client.connection.SetWriteDeadline(time.Now().Add(wsConfig.WriteWait))
 			if err := client.connection.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Println("could not ping client:", err)
+				client.logger.Debug("could not ping client", "err", err)
 				return
 			}
 		}
@@ -75,15 +104,19 @@ func (client *Client) WriteMsgs() {
 func (client *Client) ReadUserMsgs() {
 	defer client.manager.removeClient(client)
 
-	client.connection.SetReadLimit(int64(maxMessageSize))
-	client.connection.SetReadDeadline(time.Now().Add(pongWait))
-	client.connection.SetPongHandler(func(string) error { client.connection.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	wsConfig := client.manager.config.Websocket
+	client.connection.SetReadLimit(wsConfig.MaxMessageSize)
+	client.connection.SetReadDeadline(time.Now().Add(wsConfig.PongWait))
+	client.connection.SetPongHandler(func(string) error {
+		client.connection.SetReadDeadline(time.Now().Add(wsConfig.PongWait))
+		return nil
+	})
 
 	for {
 		_, payload, err := client.connection.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Println("Error reading message:", err)
+				client.logger.Warn("error reading message", "err", err)
 			}
 			break
 		}
@@ -96,15 +129,16 @@ func (client *Client) ReadUserMsgs() {
 		// Marshal data into Event
 		var request SocketEvent
 		if err := json.Unmarshal(payload, &request); err != nil {
-			log.Println("error unmarshalling message:", err)
+			client.logger.Warn("error unmarshalling message", "err", err)
 			continue
 		}
-		// Push event to manager
-		client.manager.clientRequests <- ClientRequest{client, &request}
+		// Push event to manager, waits while the client's worker is busy
+		reqLogger := client.logger.With("requestId", newId())
+		client.manager.requests.submit(ClientRequest{client, &request, reqLogger})
 		//if err := client.manager.routeEvent(request, client); err != nil {
-		//	log.Println("Error handling message:", err)
+		//	client.logger.Warn("error handling message", "err", err)
 		//}
 	}
 
-	log.Println("Closing")
+	client.logger.Debug("closing connection")
 }
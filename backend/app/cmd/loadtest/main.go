@@ -0,0 +1,385 @@
+// Simulates canvas clients against a running server:
+//
+//	go run ./cmd/loadtest -addr http://localhost:5000 -clients 2000 -rate 0.5 -duration 1m
+//
+// Every client connects via websocket, subscribes to the sections intersecting a
+// viewport at a random spot of the canvas and places pixels inside of it. Each
+// placed pixel is unique, so the time until it arrives at each subscribed client
+// (the fan-out latency) can be measured and pixels which never arrive are counted
+// as dropped. The server's /metrics are sampled for its resource use.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type options struct {
+	addr        string
+	clients     int
+	connectRate float64
+	rate        float64
+	duration    time.Duration
+	drain       time.Duration
+	viewportW   int
+	viewportH   int
+	colors      []int // ids of the palette's colors
+}
+
+type SocketEvent struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+type SetPixelData struct {
+	SecId   string `json:"secId"`
+	PixIdx  int    `json:"pixIdx"`
+	ColorId int    `json:"colorId"`
+}
+
+type Point struct{ X, Y int }
+
+func (p *Point) UnmarshalJSON(data []byte) error {
+	var arr [2]int
+	if err := json.Unmarshal(data, &arr); err != nil {
+		return err
+	}
+	p.X, p.Y = arr[0], arr[1]
+	return nil
+}
+
+type Section struct {
+	TopLeft  Point  `json:"topLeft"`
+	BotRight Point  `json:"botRight"`
+	Id       string `json:"id"`
+}
+
+type ColorChoice struct {
+	Id int `json:"id"`
+}
+
+type SectionsMeta struct {
+	Sections []Section `json:"sections"`
+}
+
+func main() {
+	var opts options
+	var viewport string
+	flag.StringVar(&opts.addr, "addr", "http://localhost:5000", "base url of the server")
+	flag.IntVar(&opts.clients, "clients", 1000, "number of websocket clients")
+	flag.Float64Var(&opts.connectRate, "connect-rate", 200, "new connections per second")
+	flag.Float64Var(&opts.rate, "rate", 0.2, "pixels placed per second and client")
+	flag.DurationVar(&opts.duration, "duration", 30*time.Second, "how long pixels are placed once all clients are connected")
+	flag.DurationVar(&opts.drain, "drain", 3*time.Second, "how long to wait for outstanding pixels at the end")
+	flag.StringVar(&viewport, "viewport", "1920x1080", "size of the canvas area each client looks at, in pixels")
+	flag.Parse()
+	if _, err := fmt.Sscanf(viewport, "%dx%d", &opts.viewportW, &opts.viewportH); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid viewport %q\n", viewport)
+		os.Exit(2)
+	}
+	opts.addr = strings.TrimSuffix(opts.addr, "/")
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, opts); err != nil {
+		slog.Error("load test failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, opts options) error {
+	meta, err := fetchSections(opts.addr)
+	if err != nil {
+		return fmt.Errorf("could not fetch sections: %w", err)
+	}
+	if len(meta.Sections) == 0 {
+		return fmt.Errorf("server has no sections")
+	}
+	// The server rejects ids which aren't in the palette, those pixels would count as dropped
+	colors, err := fetchColors(opts.addr)
+	if err != nil {
+		return fmt.Errorf("could not fetch colors: %w", err)
+	}
+	if len(colors) == 0 {
+		return fmt.Errorf("server has no colors")
+	}
+	for _, color := range colors {
+		opts.colors = append(opts.colors, color.Id)
+	}
+	slog.Info("starting load test", "clients", opts.clients, "sections", len(meta.Sections), "rate", opts.rate, "duration", opts.duration)
+
+	stats := newStats()
+	sampler := newMetricsSampler(opts.addr + "/metrics")
+	go sampler.run(ctx, time.Second)
+
+	// Connect everybody first so that the fan-out is measured at full load
+	clients := make([]*client, 0, opts.clients)
+	interval := time.Duration(float64(time.Second) / opts.connectRate)
+	connectStart := time.Now()
+	for i := range opts.clients {
+		if ctx.Err() != nil {
+			break
+		}
+		c, err := connect(opts, meta.Sections, stats)
+		if err != nil {
+			stats.connectErrors.Add(1)
+			slog.Debug("could not connect", "client", i, "err", err)
+			continue
+		}
+		clients = append(clients, c)
+		time.Sleep(interval)
+	}
+	slog.Info("connected clients", "connected", len(clients), "failed", stats.connectErrors.Load(), "took", time.Since(connectStart).Round(time.Millisecond))
+	sampler.mark()
+
+	placeCtx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+	var placing sync.WaitGroup
+	for _, c := range clients {
+		placing.Add(1)
+		go func() {
+			defer placing.Done()
+			c.placePixels(placeCtx, opts)
+		}()
+	}
+	placing.Wait()
+	placeDuration := time.Since(sampler.markedAt())
+
+	slog.Info("waiting for outstanding pixels", "drain", opts.drain)
+	time.Sleep(opts.drain)
+	serverUsage := sampler.since()
+	for _, c := range clients {
+		c.conn.Close()
+	}
+
+	stats.report(os.Stdout, placeDuration, serverUsage)
+	return nil
+}
+
+func fetchSections(addr string) (*SectionsMeta, error) {
+	var meta SectionsMeta
+	if err := getJSON(addr+"/sections", &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func fetchColors(addr string) ([]ColorChoice, error) {
+	var colors []ColorChoice
+	err := getJSON(addr+"/colors", &colors)
+	return colors, err
+}
+
+func getJSON(url string, v any) error {
+	res, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+type client struct {
+	conn     *websocket.Conn
+	viewport []viewportSection
+	writeMu  sync.Mutex
+	stats    *stats
+}
+
+// The part of a section which is visible to a client
+type viewportSection struct {
+	Section
+	minX, minY, maxX, maxY int // section relative, exclusive max
+}
+
+// Places a viewport at a random spot of the canvas and subscribes to the sections it intersects
+func connect(opts options, sections []Section, stats *stats) (*client, error) {
+	minX, minY, maxX, maxY := canvasBounds(sections)
+	x := minX + rand.IntN(max(1, maxX-minX-opts.viewportW))
+	y := minY + rand.IntN(max(1, maxY-minY-opts.viewportH))
+
+	c := &client{stats: stats}
+	for _, s := range sections {
+		left, top := max(x, s.TopLeft.X), max(y, s.TopLeft.Y)
+		right, bot := min(x+opts.viewportW, s.BotRight.X), min(y+opts.viewportH, s.BotRight.Y)
+		if left < right && top < bot {
+			c.viewport = append(c.viewport, viewportSection{s, left - s.TopLeft.X, top - s.TopLeft.Y, right - s.TopLeft.X, bot - s.TopLeft.Y})
+		}
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(opts.addr, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+
+	secIds := make([]string, len(c.viewport))
+	for i, s := range c.viewport {
+		secIds[i] = s.Id
+	}
+	if err := c.send("subscribe", secIds); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for _, secId := range secIds {
+		stats.subscribe(secId)
+	}
+	go c.readPixels()
+	return c, nil
+}
+
+func canvasBounds(sections []Section) (minX, minY, maxX, maxY int) {
+	minX, minY, maxX, maxY = sections[0].TopLeft.X, sections[0].TopLeft.Y, sections[0].BotRight.X, sections[0].BotRight.Y
+	for _, s := range sections[1:] {
+		minX, minY = min(minX, s.TopLeft.X), min(minY, s.TopLeft.Y)
+		maxX, maxY = max(maxX, s.BotRight.X), max(maxY, s.BotRight.Y)
+	}
+	return
+}
+
+func (c *client) send(eventType string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteJSON(SocketEvent{eventType, b})
+}
+
+func (c *client) readPixels() {
+	for {
+		_, payload, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		var evt SocketEvent
+		if err := json.Unmarshal(payload, &evt); err != nil || evt.Type != "set_pixel" {
+			continue
+		}
+		var pixel SetPixelData
+		if err := json.Unmarshal(evt.Data, &pixel); err != nil {
+			continue
+		}
+		c.stats.received(pixel, received)
+	}
+}
+
+// Places pixels at random spots of the viewport with exponentially distributed
+// pauses, i.e. opts.rate pixels per second on average
+func (c *client) placePixels(ctx context.Context, opts options) {
+	if len(c.viewport) == 0 || opts.rate <= 0 {
+		return
+	}
+	for {
+		pause := time.Duration(rand.ExpFloat64() / opts.rate * float64(time.Second))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pause):
+		}
+
+		s := c.viewport[rand.IntN(len(c.viewport))]
+		x := s.minX + rand.IntN(s.maxX-s.minX)
+		y := s.minY + rand.IntN(s.maxY-s.minY)
+		pixel := SetPixelData{s.Id, y*(s.BotRight.X-s.TopLeft.X) + x, opts.colors[rand.IntN(len(opts.colors))]}
+		if !c.stats.sent(pixel) {
+			continue // the same pixel is still in flight
+		}
+		if err := c.send("set_pixel", pixel); err != nil {
+			c.stats.sendErrors.Add(1)
+			c.stats.forget(pixel)
+			return
+		}
+	}
+}
+
+type inFlightPixel struct {
+	sentAt   time.Time
+	expected int
+	received int
+}
+
+type stats struct {
+	mu            sync.Mutex
+	subscribers   map[string]int
+	inFlight      map[SetPixelData]*inFlightPixel
+	latencies     []time.Duration
+	placed        int
+	expected      int
+	unexpected    int
+	connectErrors atomic.Int64
+	sendErrors    atomic.Int64
+}
+
+func newStats() *stats {
+	return &stats{
+		subscribers: make(map[string]int),
+		inFlight:    make(map[SetPixelData]*inFlightPixel),
+	}
+}
+
+func (s *stats) subscribe(secId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers[secId]++
+}
+
+// Registers a pixel about to be placed. Returns false if an identical pixel is
+// still on its way, its deliveries couldn't be told apart.
+func (s *stats) sent(pixel SetPixelData) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.inFlight[pixel]; ok {
+		return false
+	}
+	expected := s.subscribers[pixel.SecId]
+	s.inFlight[pixel] = &inFlightPixel{sentAt: time.Now(), expected: expected}
+	s.placed++
+	s.expected += expected
+	return true
+}
+
+func (s *stats) forget(pixel SetPixelData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.inFlight[pixel]; ok {
+		s.placed--
+		s.expected -= p.expected
+		delete(s.inFlight, pixel)
+	}
+}
+
+func (s *stats) received(pixel SetPixelData, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.inFlight[pixel]
+	if !ok {
+		// Placed by somebody else, or a duplicate delivery
+		s.unexpected++
+		return
+	}
+	s.latencies = append(s.latencies, at.Sub(p.sentAt))
+	p.received++
+	if p.received >= p.expected {
+		delete(s.inFlight, pixel)
+	}
+}
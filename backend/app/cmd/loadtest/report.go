@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (s *stats) report(w io.Writer, placeDuration time.Duration, usage serverUsage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivered := len(s.latencies)
+	dropped := s.expected - delivered
+	slices.Sort(s.latencies)
+	percentile := func(p float64) time.Duration {
+		if delivered == 0 {
+			return 0
+		}
+		return s.latencies[min(delivered-1, int(p*float64(delivered)))].Round(10 * time.Microsecond)
+	}
+
+	fmt.Fprintf(w, "\n== clients\n")
+	fmt.Fprintf(w, "connect errors     %d\n", s.connectErrors.Load())
+	fmt.Fprintf(w, "send errors        %d\n", s.sendErrors.Load())
+	fmt.Fprintf(w, "\n== pixels (over %s)\n", placeDuration.Round(time.Millisecond))
+	fmt.Fprintf(w, "placed             %d (%.1f/s)\n", s.placed, float64(s.placed)/placeDuration.Seconds())
+	fmt.Fprintf(w, "expected           %d deliveries\n", s.expected)
+	fmt.Fprintf(w, "delivered          %d (%.1f/s)\n", delivered, float64(delivered)/placeDuration.Seconds())
+	fmt.Fprintf(w, "dropped            %d (%.3f%%)\n", dropped, 100*float64(dropped)/float64(max(1, s.expected)))
+	fmt.Fprintf(w, "unexpected         %d\n", s.unexpected)
+	fmt.Fprintf(w, "\n== fan-out latency\n")
+	for _, p := range []float64{0.5, 0.9, 0.99, 0.999} {
+		fmt.Fprintf(w, "p%-17s %s\n", strconv.FormatFloat(p*100, 'f', -1, 64), percentile(p))
+	}
+	fmt.Fprintf(w, "max                %s\n", percentile(1))
+	fmt.Fprintf(w, "\n== server (from /metrics)\n")
+	if !usage.ok {
+		fmt.Fprintf(w, "not available\n")
+		return
+	}
+	fmt.Fprintf(w, "cpu                %.2f cores\n", usage.cpuCores)
+	fmt.Fprintf(w, "max rss            %.1f MiB\n", usage.maxRSS/(1<<20))
+	fmt.Fprintf(w, "max goroutines     %.0f\n", usage.maxGoroutines)
+	fmt.Fprintf(w, "max clients        %.0f\n", usage.maxClients)
+	fmt.Fprintf(w, "max fan-out queue  %.0f\n", usage.maxFanoutQueue)
+	fmt.Fprintf(w, "max request queue  %.0f\n", usage.maxRequestQueue)
+}
+
+// Periodically scrapes the server's prometheus metrics
+type metricsSampler struct {
+	url     string
+	mu      sync.Mutex
+	samples []metricsSample
+	marked  time.Time
+}
+
+type metricsSample struct {
+	at     time.Time
+	values map[string]float64
+}
+
+type serverUsage struct {
+	ok              bool
+	cpuCores        float64
+	maxRSS          float64
+	maxGoroutines   float64
+	maxClients      float64
+	maxFanoutQueue  float64
+	maxRequestQueue float64
+}
+
+func newMetricsSampler(url string) *metricsSampler {
+	return &metricsSampler{url: url}
+}
+
+func (m *metricsSampler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.sample()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *metricsSampler) sample() {
+	values, err := scrape(m.url)
+	if err != nil {
+		slog.Debug("could not scrape metrics", "err", err)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, metricsSample{time.Now(), values})
+}
+
+// Starts the measured period
+func (m *metricsSampler) mark() {
+	m.sample()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.marked = time.Now()
+}
+
+func (m *metricsSampler) markedAt() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.marked
+}
+
+// Resource use between mark and now
+func (m *metricsSampler) since() serverUsage {
+	m.sample()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var usage serverUsage
+	var first, last *metricsSample
+	for i := range m.samples {
+		sample := &m.samples[i]
+		if sample.at.Before(m.marked.Add(-time.Second)) {
+			continue
+		}
+		if first == nil {
+			first = sample
+		}
+		last = sample
+		usage.maxRSS = max(usage.maxRSS, sample.values["process_resident_memory_bytes"])
+		usage.maxGoroutines = max(usage.maxGoroutines, sample.values["go_goroutines"])
+		usage.maxClients = max(usage.maxClients, sample.values["bipix_connected_clients"])
+		usage.maxFanoutQueue = max(usage.maxFanoutQueue, sample.values["bipix_fanout_queue_depth"])
+		usage.maxRequestQueue = max(usage.maxRequestQueue, sample.values["bipix_client_request_queue_depth"])
+	}
+	if first == nil || first == last {
+		return usage
+	}
+	usage.ok = true
+	cpu := last.values["process_cpu_seconds_total"] - first.values["process_cpu_seconds_total"]
+	usage.cpuCores = cpu / last.at.Sub(first.at).Seconds()
+	return usage
+}
+
+// Reads the metrics without labels from the prometheus text format
+func scrape(url string) (map[string]float64, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status %s", res.Status)
+	}
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		if !ok || strings.Contains(name, "{") {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			values[name] = v
+		}
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sync"
+)
+
+// How the distance between two colors is measured when matching image colors
+// to the palette
+type ColorMetric string
+
+const (
+	MetricRGB         ColorMetric = "rgb"          // squared distance of the rgb values
+	MetricWeightedRGB ColorMetric = "weighted-rgb" // rgb weighted by how sensitive the eye is to each channel ("redmean")
+	MetricCIE76       ColorMetric = "cie76"        // distance in CIELAB
+	MetricCIEDE2000   ColorMetric = "ciede2000"    // CIELAB with corrections for hue and dark colors, slowest
+	MetricOKLab       ColorMetric = "oklab"        // distance in OKLab, perceptually uniform and cheap
+)
+
+func parseColorMetric(s string) (ColorMetric, error) {
+	switch metric := ColorMetric(s); metric {
+	case MetricRGB, MetricWeightedRGB, MetricCIE76, MetricCIEDE2000, MetricOKLab:
+		return metric, nil
+	}
+	return "", fmt.Errorf("unknown color metric %q (expected rgb, weighted-rgb, cie76, ciede2000 or oklab)", s)
+}
+
+// A metric measures distances between colors converted into its color space
+type colorSpace struct {
+	convert  func(c Color) [3]float64
+	distance func(a, b [3]float64) float64
+}
+
+var colorSpaces = map[ColorMetric]colorSpace{
+	MetricRGB:         {rgbValues, squaredDistance},
+	MetricWeightedRGB: {rgbValues, redmeanDistance},
+	MetricCIE76:       {toLab, squaredDistance},
+	MetricCIEDE2000:   {toLab, ciede2000},
+	MetricOKLab:       {toOKLab, squaredDistance},
+}
+
+func rgbValues(c Color) [3]float64 {
+	return [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+}
+
+func squaredDistance(a, b [3]float64) float64 {
+	d0, d1, d2 := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return d0*d0 + d1*d1 + d2*d2
+}
+
+// https://www.compuphase.com/cmetric.htm
+func redmeanDistance(a, b [3]float64) float64 {
+	rMean := (a[0] + b[0]) / 2
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return (2+rMean/256)*dr*dr + 4*dg*dg + (2+(255-rMean)/256)*db*db
+}
+
+func linearize(v byte) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// CIELAB relative to D65
+func toLab(c Color) [3]float64 {
+	r, g, b := linearize(c.R), linearize(c.G), linearize(c.B)
+	x := (0.4124564*r + 0.3575761*g + 0.1804375*b) / 0.95047
+	y := 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z := (0.0193339*r + 0.1191920*g + 0.9503041*b) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// https://bottosson.github.io/posts/oklab/
+func toOKLab(c Color) [3]float64 {
+	r, g, b := linearize(c.R), linearize(c.G), linearize(c.B)
+	l := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*b)
+	m := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*b)
+	s := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*b)
+	return [3]float64{
+		0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+// ΔE00 of two CIELAB colors, following Sharma, Wu and Dalal (2005)
+func ciede2000(lab1, lab2 [3]float64) float64 {
+	const deg = math.Pi / 180
+	l1, a1, b1 := lab1[0], lab1[1], lab1[2]
+	l2, a2, b2 := lab2[0], lab2[1], lab2[2]
+
+	c1, c2 := math.Hypot(a1, b1), math.Hypot(a2, b2)
+	cMean7 := math.Pow((c1+c2)/2, 7)
+	g := 0.5 * (1 - math.Sqrt(cMean7/(cMean7+math.Pow(25, 7))))
+	a1, a2 = a1*(1+g), a2*(1+g)
+	c1, c2 = math.Hypot(a1, b1), math.Hypot(a2, b2)
+	hue := func(a, b float64) float64 {
+		if a == 0 && b == 0 {
+			return 0
+		}
+		h := math.Atan2(b, a) / deg
+		if h < 0 {
+			h += 360
+		}
+		return h
+	}
+	h1, h2 := hue(a1, b1), hue(a2, b2)
+
+	dL, dC := l2-l1, c2-c1
+	dh := 0.0
+	if c1*c2 != 0 {
+		dh = h2 - h1
+		if dh > 180 {
+			dh -= 360
+		} else if dh < -180 {
+			dh += 360
+		}
+	}
+	dH := 2 * math.Sqrt(c1*c2) * math.Sin(dh/2*deg)
+
+	lMean, cMean := (l1+l2)/2, (c1+c2)/2
+	hMean := h1 + h2
+	if c1*c2 != 0 {
+		switch {
+		case math.Abs(h1-h2) <= 180:
+			hMean /= 2
+		case h1+h2 < 360:
+			hMean = (hMean + 360) / 2
+		default:
+			hMean = (hMean - 360) / 2
+		}
+	}
+	t := 1 - 0.17*math.Cos((hMean-30)*deg) + 0.24*math.Cos(2*hMean*deg) +
+		0.32*math.Cos((3*hMean+6)*deg) - 0.20*math.Cos((4*hMean-63)*deg)
+	lMean50 := (lMean - 50) * (lMean - 50)
+	sL := 1 + 0.015*lMean50/math.Sqrt(20+lMean50)
+	sC := 1 + 0.045*cMean
+	sH := 1 + 0.015*cMean*t
+	cMean7 = math.Pow(cMean, 7)
+	rT := -2 * math.Sqrt(cMean7/(cMean7+math.Pow(25, 7))) *
+		math.Sin(60*math.Exp(-math.Pow((hMean-275)/25, 2))*deg)
+
+	return math.Sqrt(math.Pow(dL/sL, 2) + math.Pow(dC/sC, 2) + math.Pow(dH/sH, 2) + rT*(dC/sC)*(dH/sH))
+}
+
+// Shards of the match cache, and how many colors each keeps before starting over
+const (
+	matchCacheShards    = 64
+	matchCacheShardSize = 1 << 14
+)
+
+// Finds the closest palette color under one metric. Matches are cached by rgb
+// value, images rarely have more than a few thousand distinct colors.
+type colorMatcher struct {
+	space   colorSpace
+	ids     []int
+	palette [][3]float64
+	shards  [matchCacheShards]struct {
+		sync.RWMutex
+		matches map[uint32]int
+	}
+}
+
+func newColorMatcher(cp *ColorProvider, metric ColorMetric) *colorMatcher {
+	m := &colorMatcher{space: colorSpaces[metric], ids: slices.Sorted(maps.Keys(cp.colors))}
+	for _, id := range m.ids {
+		m.palette = append(m.palette, m.space.convert(*cp.colors[id]))
+	}
+	for i := range m.shards {
+		m.shards[i].matches = make(map[uint32]int)
+	}
+	return m
+}
+
+func (m *colorMatcher) closest(c Color) int {
+	key := uint32(c.R)<<16 | uint32(c.G)<<8 | uint32(c.B)
+	shard := &m.shards[key%matchCacheShards]
+	shard.RLock()
+	id, ok := shard.matches[key]
+	shard.RUnlock()
+	if ok {
+		return id
+	}
+
+	converted := m.space.convert(c)
+	minDistance := math.Inf(1)
+	for i, p := range m.palette {
+		if d := m.space.distance(converted, p); d < minDistance {
+			minDistance = d
+			id = m.ids[i]
+		}
+	}
+
+	shard.Lock()
+	if len(shard.matches) >= matchCacheShardSize {
+		clear(shard.matches)
+	}
+	shard.matches[key] = id
+	shard.Unlock()
+	return id
+}
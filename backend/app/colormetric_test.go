@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"testing"
+)
+
+// Test data from Sharma, Wu and Dalal, "The CIEDE2000 Color-Difference Formula"
+func TestCIEDE2000(t *testing.T) {
+	for i, tc := range []struct {
+		lab1, lab2 [3]float64
+		want       float64
+	}{
+		{[3]float64{50, 2.6772, -79.7751}, [3]float64{50, 0, -82.7485}, 2.0425},
+		{[3]float64{50, 0, 0}, [3]float64{50, -1, 2}, 2.3669},
+		{[3]float64{50, 2.49, -0.001}, [3]float64{50, -2.49, 0.0009}, 7.1792},
+		{[3]float64{50, 2.49, -0.001}, [3]float64{50, -2.49, 0.0011}, 7.2195},
+		{[3]float64{50, 2.5, 0}, [3]float64{73, 25, -18}, 27.1492},
+		{[3]float64{50, 2.5, 0}, [3]float64{61, -5, 29}, 22.8977},
+		{[3]float64{60.2574, -34.0099, 36.2677}, [3]float64{60.4626, -34.1751, 39.4387}, 1.2644},
+		{[3]float64{2.0776, 0.0795, -1.135}, [3]float64{0.9033, -0.0636, -0.5514}, 0.9082},
+	} {
+		if got := ciede2000(tc.lab1, tc.lab2); math.Abs(got-tc.want) > 1e-4 {
+			t.Errorf("pair %d: got %.4f, want %.4f", i, got, tc.want)
+		}
+		if got := ciede2000(tc.lab2, tc.lab1); math.Abs(got-tc.want) > 1e-4 {
+			t.Errorf("pair %d swapped: got %.4f, want %.4f", i, got, tc.want)
+		}
+	}
+}
+
+func TestPerceptualMetricsMatchDarkColors(t *testing.T) {
+	cp := NewColorProvider(2, FromHex("#000000"), FromHex("#808080"), FromHex("#0000ff"), FromHex("#ff0000"))
+	navy := NewColor(0, 0, 0x77)
+	for metric, want := range map[ColorMetric]string{
+		MetricRGB:       "#000000",
+		MetricOKLab:     "#0000ff",
+		MetricCIEDE2000: "#0000ff",
+	} {
+		id, err := cp.ClosestColor(navy, metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cp.colors[id].hex(); got != want {
+			t.Errorf("%s: got %s, want %s", metric, got, want)
+		}
+	}
+
+	// Every metric finds the palette's own colors
+	for metric := range colorSpaces {
+		for id, c := range cp.colors {
+			if got, _ := cp.ClosestColor(NewColor(c.R, c.G, c.B), metric); got != id {
+				t.Errorf("%s: %s matched color %d instead of %d", metric, c.hex(), got, id)
+			}
+		}
+	}
+}
+
+func TestColorMatcherCacheIsConsistent(t *testing.T) {
+	cp := NewColorProvider(5, FromHex("#1f102a"), FromHex("#ea6262"), FromHex("#abdd64"), FromHex("#8db7ff"), FromHex("#ffffff"))
+	matcher := newColorMatcher(cp, MetricOKLab)
+	uncached := func(c Color) int {
+		return newColorMatcher(cp, MetricOKLab).closest(c)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Enough distinct colors to clear some shards along the way
+			for v := range 1 << 17 {
+				c := NewColor(byte(v>>9), byte(v>>1), byte(v*31+i))
+				matcher.closest(*c)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, v := range []int{0, 1234, 99999, 1<<17 - 1} {
+		c := *NewColor(byte(v>>9), byte(v>>1), byte(v*31))
+		if got, want := matcher.closest(c), uncached(c); got != want {
+			t.Errorf("%+v: cached %d, want %d", c, got, want)
+		}
+	}
+}
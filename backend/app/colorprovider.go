@@ -6,8 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"image/color"
-	"log"
-	"math"
+	"log/slog"
+	"sync"
 )
 
 type Color struct {
@@ -37,7 +37,7 @@ func FromHex(hexValue string) *Color {
 
 func FromColor(c color.Color) *Color {
 	r, g, b, a := c.RGBA()
-	return NewRGBAColor(byte(r), byte(g), byte(b), byte(a))
+	return NewRGBAColor(byte(r>>8), byte(g>>8), byte(b>>8), byte(a>>8))
 }
 
 func (c1 *Color) RgbEq(c2 Color) bool {
@@ -87,7 +87,7 @@ func (c *Color) MarshalJSON() ([]byte, error) {
 func TryParseRGB(data []byte, color *Color) error {
 	var rgb []int
 	if err := json.Unmarshal(data, &rgb); err != nil {
-		log.Println("error while trying to unmarshal json color as rgb list")
+		slog.Debug("error while trying to unmarshal json color as rgb list", "err", err)
 		return err
 	}
 	if len(rgb) != 3 {
@@ -100,7 +100,7 @@ func TryParseRGB(data []byte, color *Color) error {
 func TryParseHex(data []byte, color *Color) error {
 	var s string
 	if err := json.Unmarshal(data, &s); err != nil {
-		log.Println("error while trying to unmarshal json color as string")
+		slog.Debug("error while trying to unmarshal json color as string", "err", err)
 		return err
 	}
 
@@ -116,7 +116,7 @@ func TryParseHex(data []byte, color *Color) error {
 
 func (c *Color) UnmarshalJSON(data []byte) error {
 	if err := TryParseRGB(data, c); err != nil {
-		log.Println("could not parse json color as rgb list")
+		slog.Debug("could not parse json color as rgb list", "err", err)
 		if err := TryParseHex(data, c); err != nil {
 			return fmt.Errorf("could not parse json color")
 		}
@@ -132,16 +132,18 @@ type ColorProvider struct {
 	order        map[int]int
 	idHeap       IntHeap
 	nextOrderNr  int
+	// Created on first use, once the provider is complete
+	matchersMu sync.Mutex
+	matchers   map[ColorMetric]*colorMatcher
 }
 
 func NewColorProvider(bitsPerColor int, colors ...*Color) *ColorProvider {
 	cp := &ColorProvider{
-		bitsPerColor,
-		make(map[int]*Color),
-		make(map[*Color]int),
-		make(map[int]int),
-		make(IntHeap, 0),
-		0,
+		bitsPerColor: bitsPerColor,
+		colors:       make(map[int]*Color),
+		ids:          make(map[*Color]int),
+		order:        make(map[int]int),
+		idHeap:       make(IntHeap, 0),
 	}
 
 	for _, color := range colors {
@@ -203,24 +205,42 @@ func (cp *ColorProvider) AddColor(c *Color) error {
 	return nil
 }
 
+// The colors as they are stored and served
+func (cp *ColorProvider) choices() []ColorChoice {
+	colorChoices := make([]ColorChoice, 0, len(cp.colors))
+	for id, color := range cp.colors {
+		colorChoices = append(colorChoices, ColorChoice{id, cp.order[id], []int{int(color.R), int(color.G), int(color.B)}})
+	}
+	return colorChoices
+}
+
 func (cp *ColorProvider) ClosestAvailableColor(c *Color) (int, error) {
+	return cp.ClosestColor(c, MetricRGB)
+}
+
+// Id of the palette color closest to c under the metric
+func (cp *ColorProvider) ClosestColor(c *Color, metric ColorMetric) (int, error) {
 	if len(cp.colors) == 0 {
 		return -1, fmt.Errorf("colorprovider can't determine color closest to %+v because colorprovider doesn't have any colors", *c)
 	}
 	if c.A < 50 { // take default color if (sufficiently) transparent
 		return 0, nil
 	}
-	minDistance := math.MaxInt
-	var minColorId int
-	for id, color := range cp.colors {
-		distance := IntPow(int(c.R)-int(color.R), 2) + IntPow(int(c.G)-int(color.G), 2) + IntPow(int(c.B)-int(color.B), 2)
-		if distance < minDistance {
-			minDistance = distance
-			minColorId = id
-		}
-	}
+	return cp.matcher(metric).closest(*c), nil
+}
 
-	return minColorId, nil
+func (cp *ColorProvider) matcher(metric ColorMetric) *colorMatcher {
+	cp.matchersMu.Lock()
+	defer cp.matchersMu.Unlock()
+	if cp.matchers == nil {
+		cp.matchers = make(map[ColorMetric]*colorMatcher)
+	}
+	m, ok := cp.matchers[metric]
+	if !ok {
+		m = newColorMatcher(cp, metric)
+		cp.matchers[metric] = m
+	}
+	return m
 }
 
 // https://pkg.go.dev/container/heap
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Administrative commands run via `go-serv <command> [args]` instead of starting the server
+var commands = map[string]func(ctx context.Context, cfg *Config, args []string) error{
+	"move-section": moveSectionCommand,
+	"set-user":     setUserCommand,
+}
+
+func runCommand(ctx context.Context, cfg *Config, name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %s", name)
+	}
+	return command(ctx, cfg, args)
+}
+
+func moveSectionCommand(ctx context.Context, cfg *Config, args []string) error {
+	fs := flag.NewFlagSet("move-section", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: move-section <section id> <target shard>")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return moveSection(ctx, cfg, fs.Arg(0), fs.Arg(1))
+}
+
+func setUserCommand(ctx context.Context, cfg *Config, args []string) error {
+	fs := flag.NewFlagSet("set-user", flag.ContinueOnError)
+	roleName := fs.String("role", "", "role of the user (viewer, painter, moderator or admin), new users default to admin")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: set-user [-role admin] <username>")
+		fmt.Fprintln(fs.Output(), "Creates the user or resets its password. The password is read from stdin.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if cfg.Store == "memory" {
+		return errors.New("the memory store doesn't keep users beyond this command")
+	}
+
+	username := fs.Arg(0)
+	var role Role
+	if *roleName != "" {
+		var err error
+		if role, err = parseRole(*roleName); err != nil {
+			return err
+		}
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := readLine(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("could not read password: %w", err)
+	}
+	if err := validateCredentials(username, Secret(password)); err != nil {
+		return err
+	}
+
+	store, err := NewStore(cfg)
+	if errors.Is(err, ErrStoreInUse) {
+		// The server would overwrite the change with its own copy of the users
+		return fmt.Errorf("%w, stop the server before changing users in the disk store", err)
+	} else if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Open(ctx); err != nil {
+		return err
+	}
+
+	user, err := store.User(ctx, username)
+	if errors.Is(err, ErrUserNotFound) {
+		user = User{Username: username, Role: RoleAdmin}
+	} else if err != nil {
+		return err
+	}
+	if role != "" {
+		user.Role = role
+	}
+	if err := user.changePassword(Secret(password)); err != nil {
+		return err
+	}
+	if err := store.SaveUser(ctx, user); err != nil {
+		return err
+	}
+	slog.Info("saved user", "user", user)
+	return nil
+}
+
+func readLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
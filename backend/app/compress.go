@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"log/slog"
 
 	"github.com/pierrec/lz4/v4"
 )
@@ -13,13 +13,13 @@ func Compress(data []byte) ([]byte, error) {
 
 	_, err := writer.Write(data)
 	if err != nil {
-		log.Println("could not compress section data:", err)
+		slog.Error("could not compress section data", "err", err)
 		return nil, err
 	}
 
 	err = writer.Close()
 	if err != nil {
-		log.Println("could not close writer after compressing section data:", err)
+		slog.Error("could not close writer after compressing section data", "err", err)
 		return nil, err
 	}
 
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Meant to be run with -race: clients place pixels and (un)subscribe while the
+// palette, images and positions are changed through the admin endpoints
+func TestConcurrentPlacementAndAdminTraffic(t *testing.T) {
+	srv := newTestServer(t)
+	token, err := createToken(srv.manager.config, User{Username: "admin", Role: RoleAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := testPNG(t, 20, 20)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			placePixels(t, srv, i)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 3 {
+			posId := fmt.Sprintf("pos%d", i)
+			if res, _ := srv.uploadImage(t, token, fmt.Sprintf("x=%d&y=-10&positionId=%s", -10+i*5, posId), img); res == nil || res.StatusCode != http.StatusOK {
+				t.Errorf("load-img: got %v", res)
+			}
+			if i == 1 {
+				// Re-encodes the whole canvas, which is slow with -race
+				srv.admin(t, token, "/update-colors", map[string]any{
+					"colors":       []string{"#ffffff", "#000000", "#ff0000", "#00ff00"},
+					"bitsPerColor": 6,
+					"defaultColor": "#000000",
+				})
+			}
+			srv.admin(t, token, "/delete-pos-id?pos="+posId, nil)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 50 {
+			for _, path := range []string{"/colors", "/sections?pos=pos0"} {
+				if res, err := http.Get(srv.URL + path); err == nil {
+					res.Body.Close()
+				}
+			}
+		}
+	}()
+	wg.Wait()
+
+	// Still in one piece
+	c := srv.dial(t, "")
+	c.subscribe("12")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("12") == 1 })
+	pixel := SetPixelData{SecId: "12", PixIdx: 500_500, ColorId: 2}
+	c.setPixel(pixel)
+	c.expectPixel(pixel)
+}
+
+func TestSubscribingToUnknownSection(t *testing.T) {
+	srv := newTestServer(t)
+	c := srv.dial(t, "")
+	c.subscribe("nope", "0")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("0") == 1 })
+
+	pixel := SetPixelData{SecId: "0", PixIdx: 3, ColorId: 1}
+	c.setPixel(pixel)
+	c.expectPixel(pixel)
+}
+
+// Errors are ignored, clients may get disconnected for being too slow
+func placePixels(t *testing.T, srv *testServer, seed int) {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Errorf("could not connect: %v", err)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(eventType string, data any) {
+		b, _ := json.Marshal(data)
+		conn.WriteJSON(SocketEvent{eventType, b})
+	}
+	rng := rand.New(rand.NewPCG(uint64(seed), 0))
+	for range 200 {
+		secId := fmt.Sprint(rng.IntN(25))
+		switch rng.IntN(4) {
+		case 0:
+			send(EventSubscribe, SubscribeData{secId})
+		case 1:
+			send(EventUnsubscribe, UnsubscribeData{secId})
+		default:
+			send(EventSetPixel, SetPixelData{secId, rng.IntN(1_000_000), rng.IntN(4)})
+		}
+	}
+}
+
+func (srv *testServer) admin(t *testing.T, token, path string, payload any) {
+	if status, _ := srv.post(t, path, token, payload); status != http.StatusOK {
+		t.Errorf("%s: got status %d", path, status)
+	}
+}
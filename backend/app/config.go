@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type RedisShardConfig struct {
+	Name     string `yaml:"name"`
+	Addr     string `yaml:"addr"`
+	Password Secret `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+// The redis at Addr holds the metadata. The pixel data of the sections is spread
+// across Shards; without shards it lives in the metadata redis as well.
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password Secret `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// How often redis gets pinged to determine readiness.
+	HealthCheckInterval time.Duration      `yaml:"healthCheckInterval"`
+	Shards              []RedisShardConfig `yaml:"shards"`
+}
+
+// Settings of the disk store (single node deployments without redis)
+type DiskConfig struct {
+	Dir string `yaml:"dir"`
+	// How often the write-ahead log is synced to disk. With 0 every pixel write is synced.
+	SyncInterval time.Duration `yaml:"syncInterval"`
+	// How often the section files are synced to disk and the write-ahead log is truncated.
+	CheckpointInterval time.Duration `yaml:"checkpointInterval"`
+}
+
+type WebsocketConfig struct {
+	// Time allowed to write a message to the peer.
+	WriteWait time.Duration `yaml:"writeWait"`
+	// Time allowed to read the next pong message from the peer.
+	PongWait time.Duration `yaml:"pongWait"`
+	// Maximum message size allowed from peer.
+	MaxMessageSize int64 `yaml:"maxMessageSize"`
+	// How long the session of a disconnected client can be resumed.
+	ResumeWindow time.Duration `yaml:"resumeWindow"`
+	// Maximum number of missed events buffered per disconnected client.
+	ResumeBufferSize int `yaml:"resumeBufferSize"`
+	// Number of workers routing client requests. All requests of a client are
+	// handled by the same worker, in order.
+	RequestWorkers int `yaml:"requestWorkers"`
+	// Requests queued per worker before clients have to wait to be read from.
+	RequestQueueSize int `yaml:"requestQueueSize"`
+}
+
+// Send pings to peer with this period. Must be less than PongWait.
+func (c WebsocketConfig) PingPeriod() time.Duration {
+	return (c.PongWait * 9) / 10
+}
+
+type AuthConfig struct {
+	// Issuer and audience which access tokens are created with and checked against.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// Lifetime of access tokens. Logging out revokes them early.
+	AccessTokenTTL time.Duration `yaml:"accessTokenTTL"`
+	// How long a login can be kept alive via /refresh, rotating the refresh token
+	// doesn't extend it.
+	RefreshTokenTTL time.Duration `yaml:"refreshTokenTTL"`
+	// Password checks (logins, registrations, password changes) allowed per minute,
+	// for each client address and each username, with bursts of up to AttemptBurst
+	AttemptsPerMinute int `yaml:"attemptsPerMinute"`
+	AttemptBurst      int `yaml:"attemptBurst"`
+	// What clients connecting to the websocket without credentials may do, e.g.
+	// viewer keeps them from placing pixels
+	AnonymousRole Role `yaml:"anonymousRole"`
+}
+
+// Limits of the HTTP pixel endpoints. API keys bring their own rate limit.
+type APIConfig struct {
+	// Pixels a user may set per second (and read requests they may make), with bursts of up to PixelBurst
+	PixelsPerSecond int `yaml:"pixelsPerSecond"`
+	PixelBurst      int `yaml:"pixelBurst"`
+	// Most pixels set by one PUT /pixels
+	MaxBatchSize int `yaml:"maxBatchSize"`
+	// Most pixels returned by one GET /region
+	MaxRegionPixels int `yaml:"maxRegionPixels"`
+}
+
+// Limits of images drawn onto the canvas
+type ImagesConfig struct {
+	// Largest upload accepted
+	MaxUploadBytes int64 `yaml:"maxUploadBytes"`
+	// Most pixels an image may have, before and after resizing. Checked before
+	// decoding, so that small files can't unpack into huge images.
+	MaxPixels int `yaml:"maxPixels"`
+	// How image colors are matched to the palette, unless a load asks for another
+	// metric: rgb, weighted-rgb, cie76, ciede2000 or oklab
+	ColorMetric ColorMetric `yaml:"colorMetric"`
+	// Directory /load-img may read images from by path. Empty disables it, images
+	// have to be uploaded then.
+	Dir string `yaml:"dir"`
+}
+
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type Config struct {
+	ListenAddr string `yaml:"listenAddr"`
+	// Time allowed for draining clients and in-flight work on SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	JWTSecret       Secret        `yaml:"jwtSecret"`
+	// Whether anybody may create an account via /register
+	AllowRegistration bool       `yaml:"allowRegistration"`
+	Auth              AuthConfig `yaml:"auth"`
+	// Where the canvas is kept: "redis", "disk" (single node) or "memory" (development, nothing is persisted)
+	Store     string          `yaml:"store"`
+	Redis     RedisConfig     `yaml:"redis"`
+	Disk      DiskConfig      `yaml:"disk"`
+	Websocket WebsocketConfig `yaml:"websocket"`
+	API       APIConfig       `yaml:"api"`
+	Images    ImagesConfig    `yaml:"images"`
+	Log       LogConfig       `yaml:"log"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:      ":5000",
+		ShutdownTimeout: 10 * time.Second,
+		Store:           "redis",
+		Redis: RedisConfig{
+			Addr:                "redis:6379",
+			HealthCheckInterval: 2 * time.Second,
+		},
+		Disk: DiskConfig{
+			Dir:                "data",
+			SyncInterval:       200 * time.Millisecond,
+			CheckpointInterval: 30 * time.Second,
+		},
+		Auth: AuthConfig{
+			Issuer:            "bipix",
+			Audience:          "bipix-api",
+			AccessTokenTTL:    15 * time.Minute,
+			RefreshTokenTTL:   30 * 24 * time.Hour,
+			AttemptsPerMinute: 10,
+			AttemptBurst:      20,
+			AnonymousRole:     RolePainter,
+		},
+		Websocket: WebsocketConfig{
+			WriteWait:        10 * time.Second,
+			PongWait:         20 * time.Second,
+			MaxMessageSize:   512,
+			ResumeWindow:     30 * time.Second,
+			ResumeBufferSize: 1000,
+			RequestWorkers:   64,
+			RequestQueueSize: 256,
+		},
+		API: APIConfig{
+			PixelsPerSecond: 20,
+			PixelBurst:      100,
+			MaxBatchSize:    1000,
+			MaxRegionPixels: 1 << 20,
+		},
+		Images: ImagesConfig{
+			MaxUploadBytes: 10 << 20,
+			MaxPixels:      4096 * 4096,
+			ColorMetric:    MetricRGB,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "text",
+		},
+	}
+}
+
+// Loads the config by starting from the defaults, applying the (optional) yaml file
+// pointed to by CONFIG_FILE and finally applying environment variables.
+func LoadConfig() (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (cfg *Config) loadEnv() error {
+	envString := func(key string, dst *string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+	envSecret := func(key string, dst *Secret) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = Secret(v)
+		}
+	}
+	envInt := func(key string, dst *int) error {
+		if v, ok := os.LookupEnv(key); ok {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			*dst = i
+		}
+		return nil
+	}
+	envInt64 := func(key string, dst *int64) error {
+		if v, ok := os.LookupEnv(key); ok {
+			i, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			*dst = i
+		}
+		return nil
+	}
+	envBool := func(key string, dst *bool) error {
+		if v, ok := os.LookupEnv(key); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			*dst = b
+		}
+		return nil
+	}
+	envDuration := func(key string, dst *time.Duration) error {
+		if v, ok := os.LookupEnv(key); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			*dst = d
+		}
+		return nil
+	}
+
+	envString("LISTEN_ADDR", &cfg.ListenAddr)
+	envSecret("JWT_SECRET", &cfg.JWTSecret)
+	envString("STORE", &cfg.Store)
+	envString("JWT_ISSUER", &cfg.Auth.Issuer)
+	envString("JWT_AUDIENCE", &cfg.Auth.Audience)
+	envString("REDIS_ADDR", &cfg.Redis.Addr)
+	envString("DISK_DIR", &cfg.Disk.Dir)
+	envString("IMG_DIR", &cfg.Images.Dir)
+	if v, ok := os.LookupEnv("ANONYMOUS_ROLE"); ok {
+		cfg.Auth.AnonymousRole = Role(v)
+	}
+	if v, ok := os.LookupEnv("IMG_COLOR_METRIC"); ok {
+		cfg.Images.ColorMetric = ColorMetric(v)
+	}
+	envSecret("REDIS_PASSWORD", &cfg.Redis.Password)
+	shardsErr := envShards("REDIS_SHARDS", &cfg.Redis.Shards)
+	envString("LOG_LEVEL", &cfg.Log.Level)
+	envString("LOG_FORMAT", &cfg.Log.Format)
+
+	return errors.Join(
+		shardsErr,
+		envBool("ALLOW_REGISTRATION", &cfg.AllowRegistration),
+		envInt("REDIS_DB", &cfg.Redis.DB),
+		envDuration("ACCESS_TOKEN_TTL", &cfg.Auth.AccessTokenTTL),
+		envDuration("REFRESH_TOKEN_TTL", &cfg.Auth.RefreshTokenTTL),
+		envInt("AUTH_ATTEMPTS_PER_MINUTE", &cfg.Auth.AttemptsPerMinute),
+		envInt("AUTH_ATTEMPT_BURST", &cfg.Auth.AttemptBurst),
+		envDuration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout),
+		envDuration("REDIS_HEALTH_CHECK_INTERVAL", &cfg.Redis.HealthCheckInterval),
+		envDuration("DISK_SYNC_INTERVAL", &cfg.Disk.SyncInterval),
+		envDuration("DISK_CHECKPOINT_INTERVAL", &cfg.Disk.CheckpointInterval),
+		envDuration("WS_WRITE_WAIT", &cfg.Websocket.WriteWait),
+		envDuration("WS_PONG_WAIT", &cfg.Websocket.PongWait),
+		envInt64("WS_MAX_MESSAGE_SIZE", &cfg.Websocket.MaxMessageSize),
+		envDuration("WS_RESUME_WINDOW", &cfg.Websocket.ResumeWindow),
+		envInt("WS_RESUME_BUFFER_SIZE", &cfg.Websocket.ResumeBufferSize),
+		envInt("WS_REQUEST_WORKERS", &cfg.Websocket.RequestWorkers),
+		envInt("WS_REQUEST_QUEUE_SIZE", &cfg.Websocket.RequestQueueSize),
+		envInt("API_PIXELS_PER_SECOND", &cfg.API.PixelsPerSecond),
+		envInt("API_PIXEL_BURST", &cfg.API.PixelBurst),
+		envInt("API_MAX_BATCH_SIZE", &cfg.API.MaxBatchSize),
+		envInt("API_MAX_REGION_PIXELS", &cfg.API.MaxRegionPixels),
+		envInt64("IMG_MAX_UPLOAD_BYTES", &cfg.Images.MaxUploadBytes),
+		envInt("IMG_MAX_PIXELS", &cfg.Images.MaxPixels),
+	)
+}
+
+// Parses shards given as a comma separated list of name=addr or name=addr/db,
+// e.g. REDIS_SHARDS=a=redis-a:6379,b=redis-b:6379/1
+func envShards(key string, dst *[]RedisShardConfig) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	shards := make([]RedisShardConfig, 0)
+	for _, entry := range strings.Split(v, ",") {
+		if entry == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid value for %s: expected name=addr, got %q", key, entry)
+		}
+		shard := RedisShardConfig{Name: name, Addr: addr}
+		if addr, db, ok := strings.Cut(addr, "/"); ok {
+			i, err := strconv.Atoi(db)
+			if err != nil {
+				return fmt.Errorf("invalid value for %s: %w", key, err)
+			}
+			shard.Addr, shard.DB = addr, i
+		}
+		shards = append(shards, shard)
+	}
+	*dst = shards
+	return nil
+}
+
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.JWTSecret == "" {
+		errs = append(errs, errors.New("JWT_SECRET must not be empty"))
+	}
+	if cfg.Auth.Issuer == "" || cfg.Auth.Audience == "" {
+		errs = append(errs, errors.New("jwt issuer and audience must not be empty"))
+	}
+	if cfg.Auth.AccessTokenTTL <= 0 || cfg.Auth.RefreshTokenTTL <= 0 {
+		errs = append(errs, errors.New("access and refresh token ttl must be positive"))
+	}
+	if cfg.Auth.AttemptsPerMinute <= 0 || cfg.Auth.AttemptBurst <= 0 {
+		errs = append(errs, errors.New("auth attempt rate limits must be positive"))
+	}
+	if _, err := parseRole(string(cfg.Auth.AnonymousRole)); err != nil {
+		errs = append(errs, fmt.Errorf("anonymous role: %w", err))
+	}
+	if cfg.ListenAddr == "" {
+		errs = append(errs, errors.New("listen address must not be empty"))
+	}
+	switch cfg.Store {
+	case "redis", "memory":
+	case "disk":
+		if cfg.Disk.Dir == "" {
+			errs = append(errs, errors.New("disk store needs a directory"))
+		}
+		if cfg.Disk.SyncInterval < 0 || cfg.Disk.CheckpointInterval <= 0 {
+			errs = append(errs, errors.New("disk sync interval must not be negative, checkpoint interval must be positive"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown store %q, expected redis, disk or memory", cfg.Store))
+	}
+	if cfg.Redis.Addr == "" {
+		errs = append(errs, errors.New("redis address must not be empty"))
+	}
+	shardNames := make(map[string]struct{})
+	for _, shard := range cfg.Redis.Shards {
+		if shard.Name == "" || shard.Addr == "" {
+			errs = append(errs, errors.New("redis shards need a name and an address"))
+		}
+		if _, ok := shardNames[shard.Name]; ok {
+			errs = append(errs, fmt.Errorf("duplicate redis shard %q", shard.Name))
+		}
+		shardNames[shard.Name] = struct{}{}
+	}
+	if cfg.Redis.HealthCheckInterval <= 0 {
+		errs = append(errs, errors.New("redis health check interval must be positive"))
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown timeout must be positive"))
+	}
+	if cfg.API.PixelsPerSecond <= 0 || cfg.API.PixelBurst <= 0 || cfg.API.MaxBatchSize <= 0 || cfg.API.MaxRegionPixels <= 0 {
+		errs = append(errs, errors.New("api rate limits and sizes must be positive"))
+	}
+	if cfg.Images.MaxUploadBytes <= 0 || cfg.Images.MaxPixels <= 0 {
+		errs = append(errs, errors.New("image upload size and pixel limits must be positive"))
+	}
+	if _, err := parseColorMetric(string(cfg.Images.ColorMetric)); err != nil {
+		errs = append(errs, err)
+	}
+	if cfg.Websocket.WriteWait <= 0 {
+		errs = append(errs, errors.New("websocket write wait must be positive"))
+	}
+	if cfg.Websocket.PongWait <= 0 {
+		errs = append(errs, errors.New("websocket pong wait must be positive"))
+	}
+	if cfg.Websocket.MaxMessageSize <= 0 {
+		errs = append(errs, errors.New("websocket max message size must be positive"))
+	}
+	if cfg.Websocket.ResumeWindow <= 0 {
+		errs = append(errs, errors.New("websocket resume window must be positive"))
+	}
+	if cfg.Websocket.ResumeBufferSize < 0 {
+		errs = append(errs, errors.New("websocket resume buffer size must not be negative"))
+	}
+	if cfg.Websocket.RequestWorkers <= 0 || cfg.Websocket.RequestQueueSize <= 0 {
+		errs = append(errs, errors.New("websocket request workers and queue size must be positive"))
+	}
+	if _, err := parseLogLevel(cfg.Log.Level); err != nil {
+		errs = append(errs, err)
+	}
+	switch cfg.Log.Format {
+	case "text", "json":
+	default:
+		errs = append(errs, fmt.Errorf("unknown log format %q (expected text or json)", cfg.Log.Format))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,655 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ CanvasStore = (*DiskStore)(nil)
+
+// Keeps the canvas on the local disk, for single node deployments without redis.
+// Every section lives in its own memory-mapped file, pixel writes go to the mapped
+// memory and to a write-ahead log which is replayed after a crash and truncated
+// whenever the mapped files have been synced to disk (a checkpoint). Everything
+// else is small and lives in a json file which is rewritten on every change. Only
+// one process may use the directory at a time, it is locked while the store is open.
+//
+//	<dir>/lock
+//	<dir>/meta.json
+//	<dir>/wal.log
+//	<dir>/sections/<secId>.sec
+type DiskStore struct {
+	sync.Mutex
+	dir          string
+	lock         *os.File
+	meta         diskMeta
+	servedDirty  bool
+	sections     map[string]*diskSection
+	wal          *os.File
+	walDirty     bool
+	syncInterval time.Duration
+	stop         chan struct{}
+	stopped      sync.WaitGroup
+	localPubsub
+}
+
+type diskMeta struct {
+	Sections     []SectionMetaData       `json:"sections"`
+	BitsPerColor int                     `json:"bitsPerColor"`
+	Colors       []ColorChoice           `json:"colors"`
+	Positions    map[string]PositionInfo `json:"positions"`
+	Users        map[string]User         `json:"users"`
+	tokenLists
+	Served map[string]int `json:"served"`
+}
+
+// Section files start with a fixed size header:
+//
+//	magic (4) | version (2) | bitsPerColor (1) | reserved (1) | width (4) | height (4) | data length (8) | reserved (8)
+const (
+	sectionFileMagic   = "BPXS"
+	sectionFileVersion = 1
+	sectionHeaderSize  = 32
+)
+
+type diskSection struct {
+	file   *os.File
+	mapped []byte // header + data
+	data   []byte
+	bits   int
+	width  int
+	height int
+}
+
+func NewDiskStore(cfg DiskConfig) (CanvasStore, error) {
+	s := &DiskStore{
+		dir:          cfg.Dir,
+		sections:     make(map[string]*diskSection),
+		syncInterval: cfg.SyncInterval,
+		stop:         make(chan struct{}),
+		localPubsub:  newLocalPubsub(),
+	}
+	if err := os.MkdirAll(s.sectionsDir(), 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	s.lock = lock
+	if err := s.loadMeta(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	if err := s.mapSections(); err != nil {
+		s.unmapSections()
+		lock.Close()
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(s.dir, "wal.log"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		s.unmapSections()
+		lock.Close()
+		return nil, err
+	}
+	s.wal = wal
+	if err := s.replayWal(); err != nil {
+		s.unmapSections()
+		wal.Close()
+		lock.Close()
+		return nil, err
+	}
+
+	s.stopped.Add(1)
+	go s.background(cfg.CheckpointInterval)
+	return s, nil
+}
+
+// Takes the lock on the data directory, which is released once the returned file is closed
+func lockDir(dir string) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s", ErrStoreInUse, dir)
+		}
+		return nil, fmt.Errorf("could not lock %s: %w", dir, err)
+	}
+	return file, nil
+}
+
+func (s *DiskStore) sectionsDir() string {
+	return filepath.Join(s.dir, "sections")
+}
+
+func (s *DiskStore) sectionPath(secId string) string {
+	return filepath.Join(s.sectionsDir(), url.PathEscape(secId)+".sec")
+}
+
+// Whether the store has never been written to
+func (s *DiskStore) Empty() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.meta.Sections) == 0 && s.meta.BitsPerColor == 0
+}
+
+func (s *DiskStore) loadMeta() error {
+	s.meta = diskMeta{
+		Positions:  make(map[string]PositionInfo),
+		Users:      make(map[string]User),
+		Served:     make(map[string]int),
+		tokenLists: newTokenLists(),
+	}
+	b, err := os.ReadFile(filepath.Join(s.dir, "meta.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &s.meta); err != nil {
+		return fmt.Errorf("corrupt meta.json: %w", err)
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (s *DiskStore) saveMeta() error {
+	b, err := json.Marshal(s.meta)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, "meta.json"), b); err != nil {
+		return err
+	}
+	s.servedDirty = false
+	return nil
+}
+
+// Writes to a temporary file first so that a crash leaves either the old or the new file behind
+func writeFileAtomic(path string, parts ...[]byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	for _, part := range parts {
+		if _, err := tmp.Write(part); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *DiskStore) mapSections() error {
+	entries, err := os.ReadDir(s.sectionsDir())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".sec")
+		if !ok {
+			continue
+		}
+		secId, err := url.PathUnescape(name)
+		if err != nil {
+			return err
+		}
+		section, err := mapSection(s.sectionPath(secId))
+		if err != nil {
+			return fmt.Errorf("section %s: %w", secId, err)
+		}
+		s.sections[secId] = section
+	}
+	slog.Info("mapped section files", "dir", s.sectionsDir(), "sections", len(s.sections))
+	return nil
+}
+
+func mapSection(path string) (*diskSection, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, sectionHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("could not read header: %w", err)
+	}
+	if string(header[:4]) != sectionFileMagic || binary.LittleEndian.Uint16(header[4:]) != sectionFileVersion {
+		file.Close()
+		return nil, errors.New("not a section file")
+	}
+	dataLen := int(binary.LittleEndian.Uint64(header[16:]))
+	mapped, err := unix.Mmap(int(file.Fd()), 0, sectionHeaderSize+dataLen, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &diskSection{
+		file:   file,
+		mapped: mapped,
+		data:   mapped[sectionHeaderSize:],
+		bits:   int(header[6]),
+		width:  int(binary.LittleEndian.Uint32(header[8:])),
+		height: int(binary.LittleEndian.Uint32(header[12:])),
+	}, nil
+}
+
+func (section *diskSection) sync() error {
+	return unix.Msync(section.mapped, unix.MS_SYNC)
+}
+
+func (section *diskSection) close() error {
+	err := unix.Munmap(section.mapped)
+	if closeErr := section.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *DiskStore) unmapSections() {
+	for secId, section := range s.sections {
+		if err := section.close(); err != nil {
+			slog.Warn("could not unmap section", "secId", secId, "err", err)
+		}
+	}
+	s.sections = make(map[string]*diskSection)
+}
+
+// Applies the writes which might not have made it into the section files before a crash
+func (s *DiskStore) replayWal() error {
+	records, err := readWalRecords(s.wal)
+	if errors.Is(err, errTornWal) {
+		slog.Warn("ignoring torn record at the end of the write-ahead log", "records", len(records))
+	} else if err != nil {
+		return err
+	}
+	applied := 0
+	for _, rec := range records {
+		if err := s.applyPixel(rec.Bits, rec.SetPixelData); err != nil {
+			slog.Warn("skipping write-ahead log record", "record", rec, "err", err)
+			continue
+		}
+		applied++
+	}
+	if len(records) > 0 {
+		slog.Info("replayed write-ahead log", "records", len(records), "applied", applied)
+	}
+	return s.checkpoint()
+}
+
+// Syncs the section files and truncates the write-ahead log. Must be called with the lock held.
+func (s *DiskStore) checkpoint() error {
+	for secId, section := range s.sections {
+		if err := section.sync(); err != nil {
+			return fmt.Errorf("could not sync section %s: %w", secId, err)
+		}
+	}
+	if s.servedDirty {
+		if err := s.saveMeta(); err != nil {
+			return err
+		}
+	}
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.walDirty = false
+	return s.wal.Sync()
+}
+
+// Periodically syncs the write-ahead log and checkpoints until Close is called
+func (s *DiskStore) background(checkpointInterval time.Duration) {
+	defer s.stopped.Done()
+	checkpoints := time.NewTicker(checkpointInterval)
+	defer checkpoints.Stop()
+	var syncs <-chan time.Time
+	if s.syncInterval > 0 {
+		ticker := time.NewTicker(s.syncInterval)
+		defer ticker.Stop()
+		syncs = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-syncs:
+			s.Lock()
+			if s.walDirty {
+				if err := s.wal.Sync(); err != nil {
+					slog.Error("could not sync write-ahead log", "err", err)
+				}
+				s.walDirty = false
+			}
+			s.Unlock()
+		case <-checkpoints.C:
+			s.Lock()
+			if err := s.checkpoint(); err != nil {
+				slog.Error("could not checkpoint disk store", "err", err)
+			}
+			s.Unlock()
+		}
+	}
+}
+
+func (s *DiskStore) Open(ctx context.Context) error { return nil }
+
+func (s *DiskStore) Ping(ctx context.Context) error {
+	_, err := os.Stat(s.dir)
+	return err
+}
+
+func (s *DiskStore) Close() error {
+	close(s.stop)
+	s.stopped.Wait()
+
+	s.Lock()
+	defer s.Unlock()
+	err := s.checkpoint()
+	s.unmapSections()
+	if closeErr := s.wal.Close(); err == nil {
+		err = closeErr
+	}
+	s.lock.Close()
+	return err
+}
+
+func (s *DiskStore) Reset(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.unmapSections()
+	if err := os.RemoveAll(s.sectionsDir()); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.sectionsDir(), 0o755); err != nil {
+		return err
+	}
+	s.meta = diskMeta{
+		Positions:  make(map[string]PositionInfo),
+		Users:      s.meta.Users,
+		Served:     make(map[string]int),
+		tokenLists: s.meta.tokenLists,
+	}
+	if err := s.saveMeta(); err != nil {
+		return err
+	}
+	return s.checkpoint()
+}
+
+func (s *DiskStore) SectionsMeta(ctx context.Context) ([]SectionMetaData, error) {
+	s.Lock()
+	defer s.Unlock()
+	return append([]SectionMetaData{}, s.meta.Sections...), nil
+}
+
+func (s *DiskStore) SaveSectionsMeta(ctx context.Context, sections []SectionMetaData) error {
+	s.Lock()
+	defer s.Unlock()
+	s.meta.Sections = append([]SectionMetaData{}, sections...)
+	return s.saveMeta()
+}
+
+func (s *DiskStore) SectionData(ctx context.Context, secId string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	section, ok := s.sections[secId]
+	if !ok {
+		return nil, fmt.Errorf("no data for section %s", secId)
+	}
+	return append([]byte{}, section.data...), nil
+}
+
+// Replaces the section's file. The header takes the dimensions from the section
+// metadata and bitsPerColor from the palette, so both have to be saved first.
+func (s *DiskStore) SaveSectionData(ctx context.Context, secId string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// The logged writes were made with the old layout and must not be replayed onto the new one
+	if err := s.checkpoint(); err != nil {
+		return err
+	}
+
+	width, height := 0, 0
+	for _, meta := range s.meta.Sections {
+		if meta.Id == secId {
+			width, height = meta.BotRight.X-meta.TopLeft.X, meta.BotRight.Y-meta.TopLeft.Y
+		}
+	}
+	header := make([]byte, sectionHeaderSize)
+	copy(header, sectionFileMagic)
+	binary.LittleEndian.PutUint16(header[4:], sectionFileVersion)
+	header[6] = byte(s.meta.BitsPerColor)
+	binary.LittleEndian.PutUint32(header[8:], uint32(width))
+	binary.LittleEndian.PutUint32(header[12:], uint32(height))
+	binary.LittleEndian.PutUint64(header[16:], uint64(len(data)))
+
+	path := s.sectionPath(secId)
+	if err := writeFileAtomic(path, header, data); err != nil {
+		return err
+	}
+	section, err := mapSection(path)
+	if err != nil {
+		return err
+	}
+	if old, ok := s.sections[secId]; ok {
+		if err := old.close(); err != nil {
+			slog.Warn("could not unmap replaced section", "secId", secId, "err", err)
+		}
+	}
+	s.sections[secId] = section
+	return nil
+}
+
+func (s *DiskStore) SetPixel(ctx context.Context, bitsPerColor int, setPixData SetPixelData) error {
+	s.Lock()
+	defer s.Unlock()
+
+	section, err := s.pixelSection(bitsPerColor, setPixData)
+	if err != nil {
+		return err
+	}
+	rec := appendWalRecord(nil, walRecord{setPixData, bitsPerColor})
+	if _, err := s.wal.Write(rec); err != nil {
+		return fmt.Errorf("could not append to write-ahead log: %w", err)
+	}
+	setBits(section.data, setPixData.PixIdx*bitsPerColor, bitsPerColor, setPixData.ColorId)
+
+	if s.syncInterval == 0 {
+		return s.wal.Sync()
+	}
+	s.walDirty = true
+	return nil
+}
+
+// Must be called with the lock held
+func (s *DiskStore) applyPixel(bitsPerColor int, setPixData SetPixelData) error {
+	section, err := s.pixelSection(bitsPerColor, setPixData)
+	if err != nil {
+		return err
+	}
+	setBits(section.data, setPixData.PixIdx*bitsPerColor, bitsPerColor, setPixData.ColorId)
+	return nil
+}
+
+// The section the pixel can be written to. Must be called with the lock held.
+func (s *DiskStore) pixelSection(bitsPerColor int, setPixData SetPixelData) (*diskSection, error) {
+	section, ok := s.sections[setPixData.SecId]
+	if !ok {
+		return nil, fmt.Errorf("unknown section %s", setPixData.SecId)
+	}
+	if section.bits != bitsPerColor {
+		return nil, fmt.Errorf("section %s is stored with %d bits per color, not %d", setPixData.SecId, section.bits, bitsPerColor)
+	}
+	if setPixData.PixIdx < 0 || (setPixData.PixIdx+1)*bitsPerColor > len(section.data)*8 {
+		return nil, fmt.Errorf("pixel %d out of range for section %s", setPixData.PixIdx, setPixData.SecId)
+	}
+	return section, nil
+}
+
+// Counts are only written with the next checkpoint
+func (s *DiskStore) CountSectionServed(ctx context.Context, secId string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.meta.Served[secId]++
+	s.servedDirty = true
+	return nil
+}
+
+func (s *DiskStore) Palette(ctx context.Context) (int, []ColorChoice, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.meta.BitsPerColor == 0 {
+		return 0, nil, errors.New("no palette stored")
+	}
+	return s.meta.BitsPerColor, append([]ColorChoice{}, s.meta.Colors...), nil
+}
+
+func (s *DiskStore) SavePalette(ctx context.Context, bitsPerColor int, colors []ColorChoice) error {
+	s.Lock()
+	defer s.Unlock()
+	s.meta.BitsPerColor = bitsPerColor
+	s.meta.Colors = append([]ColorChoice{}, colors...)
+	return s.saveMeta()
+}
+
+func (s *DiskStore) Positions(ctx context.Context) (map[string]PositionInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	positions := make(map[string]PositionInfo, len(s.meta.Positions))
+	for id, pos := range s.meta.Positions {
+		positions[id] = pos
+	}
+	return positions, nil
+}
+
+func (s *DiskStore) SavePosition(ctx context.Context, posId string, pos PositionInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	s.meta.Positions[posId] = pos
+	return s.saveMeta()
+}
+
+func (s *DiskStore) DeletePosition(ctx context.Context, posId string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.meta.Positions, posId)
+	return s.saveMeta()
+}
+
+func (s *DiskStore) User(ctx context.Context, username string) (User, error) {
+	s.Lock()
+	defer s.Unlock()
+	user, ok := s.meta.Users[username]
+	if !ok {
+		return User{}, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return user, nil
+}
+
+func (s *DiskStore) SaveUser(ctx context.Context, user User) error {
+	s.Lock()
+	defer s.Unlock()
+	s.meta.Users[user.Username] = user
+	return s.saveMeta()
+}
+
+func (s *DiskStore) CreateUser(ctx context.Context, user User) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.meta.Users[user.Username]; ok {
+		return fmt.Errorf("%w: %s", ErrUserExists, user.Username)
+	}
+	s.meta.Users[user.Username] = user
+	return s.saveMeta()
+}
+
+func (s *DiskStore) SaveRefreshToken(ctx context.Context, id string, token RefreshToken) error {
+	s.Lock()
+	defer s.Unlock()
+	s.meta.saveRefresh(id, token)
+	return s.saveMeta()
+}
+
+func (s *DiskStore) TakeRefreshToken(ctx context.Context, id string) (RefreshToken, error) {
+	s.Lock()
+	defer s.Unlock()
+	token, err := s.meta.takeRefresh(id)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return token, s.saveMeta()
+}
+
+func (s *DiskStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	s.meta.revoke(jti, expiresAt)
+	return s.saveMeta()
+}
+
+func (s *DiskStore) TokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.meta.revoked(jti), nil
+}
+
+func (s *DiskStore) SaveAPIKey(ctx context.Context, key APIKey) error {
+	s.Lock()
+	defer s.Unlock()
+	s.meta.APIKeys[key.Id] = key
+	return s.saveMeta()
+}
+
+func (s *DiskStore) APIKey(ctx context.Context, id string) (APIKey, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.meta.apiKey(id)
+}
+
+func (s *DiskStore) APIKeys(ctx context.Context) ([]APIKey, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.meta.apiKeyList(), nil
+}
+
+func (s *DiskStore) DeleteAPIKey(ctx context.Context, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.meta.deleteAPIKey(id); err != nil {
+		return err
+	}
+	return s.saveMeta()
+}
+
+func (s *DiskStore) EnsureSubscribed(ctx context.Context) bool { return true }
+func (s *DiskStore) Subscribed() bool                          { return true }
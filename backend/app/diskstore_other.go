@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// The disk store relies on mmap
+func NewDiskStore(cfg DiskConfig) (CanvasStore, error) {
+	return nil, errors.New("the disk store is only supported on unix systems")
+}
@@ -20,10 +20,19 @@ type SubscribeData []string
 // [secId1, secId2, ...]
 type UnsubscribeData []string
 
+// Sent by the server right after connecting. Reconnecting with ?session=<token>
+// restores the subscriptions and delivers the events missed in between.
+type SessionData struct {
+	Token   string `json:"token"`
+	Resumed bool   `json:"resumed"`
+	Missed  int    `json:"missed"`
+}
+
 type EventHandler func(event SocketEvent, c *Client) error
 
 const (
 	EventSetPixel    = "set_pixel"
 	EventSubscribe   = "subscribe"
 	EventUnsubscribe = "unsubscribe"
+	EventSession     = "session"
 )
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pierrec/lz4/v4"
+)
+
+// A server started from setupAPI on top of the in-memory store, seeded with the
+// same canvas as initStoreFromScratch
+type testServer struct {
+	*httptest.Server
+	manager *Manager
+}
+
+func testConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.Store = "memory"
+	cfg.JWTSecret = "test-secret"
+	cfg.Redis.HealthCheckInterval = 10 * time.Millisecond
+	return cfg
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServerWithConfig(t, testConfig())
+}
+
+func newTestServerWithConfig(t *testing.T, cfg *Config) *testServer {
+	t.Helper()
+	if testing.Verbose() {
+		setupLogger(os.Stderr, "debug", "text")
+	} else {
+		setupLogger(io.Discard, "error", "text")
+	}
+
+	router, manager, err := setupAPI(cfg)
+	if err != nil {
+		t.Fatalf("could not set up api: %v", err)
+	}
+	srv := &testServer{httptest.NewServer(requestLoggingMiddleware(router)), manager}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := manager.Shutdown(ctx); err != nil {
+			t.Errorf("could not shut down manager: %v", err)
+		}
+		srv.Close()
+		manager.Close()
+	})
+
+	waitFor(t, "server to become ready", func() bool {
+		res, err := http.Get(srv.URL + "/readyz")
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	})
+	return srv
+}
+
+// Polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (srv *testServer) subscribers(secId string) int {
+	srv.manager.RLock()
+	defer srv.manager.RUnlock()
+	return len(srv.manager.sectionSubs[secId])
+}
+
+func (srv *testServer) clientCount() int {
+	srv.manager.RLock()
+	defer srv.manager.RUnlock()
+	return len(srv.manager.clients)
+}
+
+// Fetches /section-data/{secId} and unpacks the color of every pixel
+func (srv *testServer) sectionColors(t *testing.T, secId string) []int {
+	t.Helper()
+	res, err := http.Get(srv.URL + "/section-data/" + secId)
+	if err != nil {
+		t.Fatalf("could not get section data: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("section data: got status %d", res.StatusCode)
+	}
+	data, err := io.ReadAll(lz4.NewReader(res.Body))
+	if err != nil {
+		t.Fatalf("could not decompress section data: %v", err)
+	}
+
+	canvas := srv.manager.canvas()
+	section, ok := canvas.section(secId)
+	if !ok {
+		t.Fatalf("unknown section %s", secId)
+	}
+	bits := canvas.colorProvider.bitsPerColor
+	colors := make([]int, 0, section.Width()*section.Height())
+	for color := range IterateSectionData(data, section.Width()*section.Height()*bits, bits) {
+		colors = append(colors, color)
+	}
+	return colors
+}
+
+// Posts the payload as json, with the token if there is one. Safe to call
+// from other goroutines than the test's.
+func (srv *testServer) post(t *testing.T, path, token string, payload any) (int, string) {
+	res, body := srv.request(t, http.MethodPost, path, token, payload)
+	if res == nil {
+		return 0, ""
+	}
+	return res.StatusCode, string(body)
+}
+
+// Like post, for any method. Without a payload the request has no body.
+func (srv *testServer) request(t *testing.T, method, path, token string, payload any) (*http.Response, []byte) {
+	var body io.Reader
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			t.Error(err)
+			return nil, nil
+		}
+		body = bytes.NewReader(b)
+	}
+	req, _ := http.NewRequest(method, srv.URL+path, body)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("%s: %v", path, err)
+		return nil, nil
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res, b
+}
+
+// A websocket client as the frontend would use it
+type testClient struct {
+	t       *testing.T
+	conn    *websocket.Conn
+	session SessionData
+}
+
+func (srv *testServer) dial(t *testing.T, session string) *testClient {
+	t.Helper()
+	if session != "" {
+		return srv.dialQuery(t, "session="+session)
+	}
+	return srv.dialQuery(t, "")
+}
+
+func (srv *testServer) dialQuery(t *testing.T, query string) *testClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	if query != "" {
+		url += "?" + query
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	c := &testClient{t: t, conn: conn}
+	t.Cleanup(func() { conn.Close() })
+
+	// Every connection starts with the session info
+	evt := c.read()
+	if evt.Type != EventSession {
+		t.Fatalf("expected session event first, got %s", evt.Type)
+	}
+	if err := json.Unmarshal(evt.Data, &c.session); err != nil {
+		t.Fatalf("could not unmarshal session: %v", err)
+	}
+	return c
+}
+
+func (c *testClient) send(eventType string, data any) {
+	c.t.Helper()
+	b, err := json.Marshal(data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if err := c.conn.WriteJSON(SocketEvent{eventType, b}); err != nil {
+		c.t.Fatalf("could not send %s: %v", eventType, err)
+	}
+}
+
+func (c *testClient) subscribe(secIds ...string) {
+	c.t.Helper()
+	c.send(EventSubscribe, SubscribeData(secIds))
+}
+
+func (c *testClient) unsubscribe(secIds ...string) {
+	c.t.Helper()
+	c.send(EventUnsubscribe, UnsubscribeData(secIds))
+}
+
+func (c *testClient) setPixel(setPixData SetPixelData) {
+	c.t.Helper()
+	c.send(EventSetPixel, setPixData)
+}
+
+func (c *testClient) read() SocketEvent {
+	c.t.Helper()
+	evt, err := c.tryRead(2 * time.Second)
+	if err != nil {
+		c.t.Fatalf("could not read event: %v", err)
+	}
+	return evt
+}
+
+func (c *testClient) tryRead(timeout time.Duration) (SocketEvent, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	var evt SocketEvent
+	_, payload, err := c.conn.ReadMessage()
+	if err != nil {
+		return evt, err
+	}
+	err = json.NewDecoder(bytes.NewReader(payload)).Decode(&evt)
+	return evt, err
+}
+
+func (c *testClient) expectPixel(want SetPixelData) {
+	c.t.Helper()
+	evt := c.read()
+	if evt.Type != EventSetPixel {
+		c.t.Fatalf("expected %s event, got %s", EventSetPixel, evt.Type)
+	}
+	var got SetPixelData
+	if err := json.Unmarshal(evt.Data, &got); err != nil {
+		c.t.Fatalf("could not unmarshal pixel: %v", err)
+	}
+	if got != want {
+		c.t.Fatalf("got pixel %+v, want %+v", got, want)
+	}
+}
+
+// Asserts that nothing arrives for a little while. The connection can't be read
+// from afterwards (gorilla/websocket fails permanently after a read timeout).
+func (c *testClient) expectSilence() {
+	c.t.Helper()
+	if evt, err := c.tryRead(100 * time.Millisecond); err == nil {
+		c.t.Fatalf("expected no event, got %s: %s", evt.Type, evt.Data)
+	}
+}
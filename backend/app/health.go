@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// What the manager needs before it can serve requests
+type readiness struct {
+	storeReachable atomic.Bool
+	loaded         atomic.Bool
+}
+
+type ReadinessStatus struct {
+	Store    bool `json:"store"`
+	Pubsub   bool `json:"pubsub"`
+	Metadata bool `json:"metadata"`
+}
+
+func (m *Manager) Ready() bool {
+	return m.ready.storeReachable.Load() && m.store.Subscribed() && m.ready.loaded.Load()
+}
+
+// Liveness: the process is up and able to answer http requests
+func (m *Manager) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+// Readiness: the store is reachable, the pubsub is subscribed and the metadata has been loaded
+func (m *Manager) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	status := ReadinessStatus{
+		Store:    m.ready.storeReachable.Load(),
+		Pubsub:   m.store.Subscribed(),
+		Metadata: m.ready.loaded.Load(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !m.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// Rejects requests until the metadata has been loaded from the store
+func (m *Manager) requireLoaded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.ready.loaded.Load() {
+			w.Header().Set("Retry-After", "2")
+			http.Error(w, "not ready yet", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Periodically pings the store and keeps the readiness state up to date. Loads
+// the metadata and starts the event loop once the store becomes reachable for the
+// first time and resubscribes the pubsub whenever it comes back after a drop.
+// Returns once Shutdown is called.
+func (m *Manager) MonitorStore() {
+	interval := m.config.Redis.HealthCheckInterval
+	for {
+		m.checkStore(interval)
+
+		select {
+		case <-m.stopEvents:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (m *Manager) checkStore(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := m.store.Ping(ctx); err != nil {
+		if m.ready.storeReachable.Swap(false) {
+			slog.Warn("lost connection to store", "err", err)
+		} else {
+			slog.Debug("store not reachable", "err", err)
+		}
+		return
+	}
+
+	if !m.ready.storeReachable.Swap(true) {
+		slog.Info("successfully connected to store")
+	}
+
+	if !m.ready.loaded.Load() {
+		if err := m.LoadFromStore(); err != nil {
+			slog.Warn("can't load data from store, retrying", "err", err)
+			return
+		}
+		m.ready.loaded.Store(true)
+		slog.Info("successfully loaded data from store")
+		m.startEventLoop()
+	}
+
+	m.store.EnsureSubscribed(ctx)
+}
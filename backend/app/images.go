@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "image/gif"
+	_ "image/jpeg"
+
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrImageTooLarge       = errors.New("image has too many pixels")
+	ErrUnsupportedImage    = errors.New("unsupported image, expected png, jpeg, gif or webp")
+	ErrFileLoadingDisabled = errors.New("loading images from files is disabled, upload the image instead")
+	ErrOutsideImageDir     = errors.New("image is outside of the image directory")
+)
+
+var imageFormats = []string{"png", "jpeg", "gif", "webp"}
+
+// Where and how large an image is drawn. With only one of W and H the image is
+// scaled proportionally, with both Fit decides how it is fitted into them.
+type ImgLoadInstructions struct {
+	// File in the image directory, for requests which don't upload the image
+	Path       string `json:"path"`
+	X          int    `json:"x"`
+	Y          int    `json:"y"`
+	W          int    `json:"w"`
+	H          int    `json:"h"`
+	PositionId string `json:"positionId"`
+	// nearest (the default), floyd-steinberg, atkinson or ordered
+	Dither string `json:"dither"`
+	// rgb, weighted-rgb, cie76, ciede2000 or oklab, the configured one by default
+	Metric string `json:"metric"`
+	// auto (the default), nearest, bilinear, catmull-rom or area
+	Resample string `json:"resample"`
+	// stretch (the default), fit, fill or crop
+	Fit string `json:"fit"`
+	// replace (the default) or blend
+	Alpha string `json:"alpha"`
+	// Only shows what would change, nothing is drawn
+	DryRun bool `json:"dryRun"`
+}
+
+func instructionsFromValues(values url.Values) (ImgLoadInstructions, error) {
+	in := ImgLoadInstructions{PositionId: values.Get("positionId"), Dither: values.Get("dither"), Metric: values.Get("metric"),
+		Resample: values.Get("resample"), Fit: values.Get("fit"), Alpha: values.Get("alpha")}
+	for name, dst := range map[string]*int{"x": &in.X, "y": &in.Y, "w": &in.W, "h": &in.H} {
+		if v := values.Get(name); v != "" {
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				return in, fmt.Errorf("%s must be an integer", name)
+			}
+			*dst = i
+		}
+	}
+	if v := values.Get("dryRun"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return in, errors.New("dryRun must be a boolean")
+		}
+		in.DryRun = dryRun
+	}
+	return in, nil
+}
+
+// Which part of the image is drawn at which size
+func (in ImgLoadInstructions) layout(bounds image.Rectangle) (imageLayout, error) {
+	fit, err := parseFitMode(in.Fit)
+	if err != nil {
+		return imageLayout{}, err
+	}
+	switch {
+	case in.W < 0 || in.H < 0:
+		return imageLayout{}, fmt.Errorf("can't draw the image at %dx%d", in.W, in.H)
+	case in.W != 0 && in.H != 0:
+		return fitInto(bounds, in.W, in.H, fit), nil
+	case in.W != 0:
+		return imageLayout{bounds, in.W, bounds.Dy() * in.W / bounds.Dx()}, nil
+	case in.H != 0:
+		return imageLayout{bounds, bounds.Dx() * in.H / bounds.Dy(), in.H}, nil
+	}
+	return imageLayout{bounds, bounds.Dx(), bounds.Dy()}, nil
+}
+
+// Decodes a png, jpeg, gif (its first frame) or webp image. Its dimensions are
+// checked before the pixels are decoded.
+func decodeImage(r io.Reader, maxPixels int) (image.Image, error) {
+	// DecodeConfig only reads the header, decoding continues with what it has read
+	var header bytes.Buffer
+	cfg, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil || !slices.Contains(imageFormats, format) {
+		return nil, ErrUnsupportedImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > maxPixels/cfg.Height {
+		return nil, fmt.Errorf("%w: %dx%d", ErrImageTooLarge, cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnsupportedImage, err)
+	}
+	return img, nil
+}
+
+// Opens a file of the image directory, which it can't be tricked into leaving
+func openImageFile(dir, name string) (*os.File, error) {
+	if dir == "" {
+		return nil, ErrFileLoadingDisabled
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, filepath.Clean("/"+name)))
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, ErrOutsideImageDir
+	}
+	return os.Open(path)
+}
+
+// Reads the image and instructions of a /load-img request. The image is either
+// uploaded as multipart form (file "image", instructions as fields), sent as
+// the raw body (instructions in the query) or named by json instructions. Older
+// clients send the json without a content type (or as text/plain), bodies which
+// start with '{' are taken as json then. The returned attribute describes where the image came from, for logging.
+func (m *Manager) readImageLoad(w http.ResponseWriter, r *http.Request) (image.Image, ImgLoadInstructions, slog.Attr, error) {
+	cfg := m.config.Images
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	source := slog.Group("source", "type", mediaType)
+	switch {
+	case mediaType == "multipart/form-data":
+		// Leaves some room for the other fields
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.MaxUploadBytes+1<<16)
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			return nil, ImgLoadInstructions{}, source, err
+		}
+		// The server only cleans up after the request it was given, not after
+		// this copy with another context
+		defer r.MultipartForm.RemoveAll()
+		in, err := instructionsFromValues(r.Form)
+		if err != nil {
+			return nil, in, source, err
+		}
+		f, header, err := r.FormFile("image")
+		if err != nil {
+			return nil, in, source, err
+		}
+		defer f.Close()
+		source = slog.Group("source", "type", mediaType, "filename", header.Filename, "bytes", header.Size)
+		if header.Size > cfg.MaxUploadBytes {
+			return nil, in, source, &http.MaxBytesError{Limit: cfg.MaxUploadBytes}
+		}
+		img, err := decodeImage(f, cfg.MaxPixels)
+		return img, in, source, err
+
+	case mediaType == "application/json", (mediaType == "" || mediaType == "text/plain") && jsonBody(r):
+		var in ImgLoadInstructions
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			return nil, in, source, err
+		}
+		source = slog.Group("source", "type", mediaType, "path", in.Path)
+		f, err := openImageFile(cfg.Dir, in.Path)
+		if err != nil {
+			return nil, in, source, err
+		}
+		defer f.Close()
+		img, err := decodeImage(f, cfg.MaxPixels)
+		return img, in, source, err
+
+	default:
+		in, err := instructionsFromValues(r.URL.Query())
+		if err != nil {
+			return nil, in, source, err
+		}
+		b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, cfg.MaxUploadBytes))
+		if err != nil {
+			return nil, in, source, err
+		}
+		source = slog.Group("source", "type", mediaType, "bytes", len(b))
+		img, err := decodeImage(bytes.NewReader(b), cfg.MaxPixels)
+		return img, in, source, err
+	}
+}
+
+// Whether the body starts with a json object, no image format does. The peeked
+// bytes stay in the body.
+func jsonBody(r *http.Request) bool {
+	br := bufio.NewReader(r.Body)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, r.Body}
+	for n := 1; ; n++ {
+		b, err := br.Peek(n)
+		if err != nil {
+			return false
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return true
+		}
+		return false
+	}
+}
+
+func (m *Manager) quantizeOptions(in ImgLoadInstructions) (quantizeOptions, error) {
+	opts := quantizeOptions{metric: m.config.Images.ColorMetric}
+	var err error
+	if opts.dither, err = parseDither(in.Dither); err != nil {
+		return opts, err
+	}
+	if in.Metric != "" {
+		if opts.metric, err = parseColorMetric(in.Metric); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// What /load-img responds with
+type ImageLoadResult struct {
+	X          int    `json:"x"`
+	Y          int    `json:"y"`
+	W          int    `json:"w"`
+	H          int    `json:"h"`
+	PositionId string `json:"positionId,omitempty"`
+	// The image in the colors it was drawn with, as png data url. For dry runs
+	// it is drawn onto the canvas as it is now.
+	Preview string `json:"preview"`
+	DryRun  bool   `json:"dryRun,omitempty"`
+	// Pixels a dry run would change, by section
+	Changes map[string]int `json:"changes,omitempty"`
+}
+
+// The canvas region with the quantized image drawn onto it, and how many
+// pixels that changes in each section
+func compositeOnto(canvas *Canvas, area Area, current, q *quantizedImage) (*quantizedImage, map[string]int) {
+	composite := &quantizedImage{current.width, current.height, slices.Clone(current.ids)}
+	changes := make(map[string]int)
+	for _, section := range canvas.sectionsIn(area) {
+		changed := 0
+		for py := max(section.meta.TopLeft.Y, area.TopLeft.Y); py < min(section.meta.BotRight.Y, area.BotRight.Y); py++ {
+			for px := max(section.meta.TopLeft.X, area.TopLeft.X); px < min(section.meta.BotRight.X, area.BotRight.X); px++ {
+				i := (py-area.TopLeft.Y)*q.width + px - area.TopLeft.X
+				if id := q.ids[i]; id != keepPixel && id != current.ids[i] {
+					composite.ids[i] = id
+					changed++
+				}
+			}
+		}
+		changes[section.meta.Id] = changed
+	}
+	return composite, changes
+}
+
+func encodePreview(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func LoadImg(w http.ResponseWriter, r *http.Request, m *Manager) {
+	logger := loggerFrom(r.Context())
+	start := time.Now()
+	defer func() { metrics.imageLoadDuration.Observe(time.Since(start).Seconds()) }()
+
+	img, payload, source, err := m.readImageLoad(w, r)
+	if err != nil {
+		logger.Warn("could not read image", source, "err", err)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			countError("LoadImg", "too_large")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprintf(w, "Images may have at most %d bytes", m.config.Images.MaxUploadBytes)
+		case errors.Is(err, ErrImageTooLarge):
+			countError("LoadImg", "too_large")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			fmt.Fprint(w, err)
+		default:
+			countError("LoadImg", "open_image")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, err)
+		}
+		return
+	}
+	logger.Info("loading image", source, "x", payload.X, "y", payload.Y, "size", img.Bounds().Size(),
+		"dither", payload.Dither, "metric", payload.Metric, "resample", payload.Resample, "fit", payload.Fit, "alpha", payload.Alpha, "dryRun", payload.DryRun)
+	opts, err := m.quantizeOptions(payload)
+	if err != nil {
+		countError("LoadImg", "options")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	resample, err := parseResample(payload.Resample)
+	if err != nil {
+		countError("LoadImg", "options")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	alpha, err := parseAlphaMode(payload.Alpha)
+	if err != nil {
+		countError("LoadImg", "options")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+
+	layout, err := payload.layout(img.Bounds())
+	if err != nil {
+		countError("LoadImg", "size")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	width, height := layout.w, layout.h
+	if width <= 0 || height <= 0 || width > m.config.Images.MaxPixels/height {
+		countError("LoadImg", "size")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Can't draw the image at %dx%d", width, height)
+		return
+	}
+	if layout.scaled() || layout.src != img.Bounds() {
+		if img, err = ResizeImage(img, layout, resample); err != nil {
+			countError("LoadImg", "resize")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	area := Area{Point{payload.X, payload.Y}, Point{payload.X + width, payload.Y + height}}
+	if key, ok := apiKeyFrom(r.Context()); ok && !key.allowsArea(area) {
+		countError("LoadImg", "outside_area")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Image exceeds the area of the API key")
+		return
+	}
+
+	canvas := m.canvas()
+	colorProvider := canvas.colorProvider
+	// What is on the canvas now, for blending and showing dry runs
+	var current *quantizedImage
+	if alpha == AlphaBlend || payload.DryRun {
+		if current, err = m.regionColors(canvas, area); err != nil {
+			logger.Error("could not load canvas under image", "err", err)
+			countError("LoadImg", "load_background")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	if alpha == AlphaBlend {
+		opts.background = current
+	}
+	quantized, err := quantize(img, colorProvider, opts)
+	if err != nil {
+		logger.Error("could not quantize image", "err", err)
+		countError("LoadImg", "quantize")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if payload.DryRun {
+		composite, changes := compositeOnto(canvas, area, current, quantized)
+		preview, err := encodePreview(composite.preview(colorProvider))
+		if err != nil {
+			logger.Error("could not encode preview", "err", err)
+			countError("LoadImg", "preview")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ImageLoadResult{payload.X, payload.Y, width, height, payload.PositionId, preview, true, changes})
+		return
+	}
+	m.PutQuantized(quantized, payload.X, payload.Y)
+
+	// register new positionId at center of img
+	if payload.PositionId != "" {
+		logger.Info("registering posId for loaded img", "posId", payload.PositionId)
+		center := *NewPoint(payload.X+width/2, payload.Y+height/2)
+		topLeft := *NewPoint(payload.X, payload.Y)
+		posInfo := PositionInfo{center, PositionImageInfo{topLeft, width, height}}
+		if err := m.store.SavePosition(*m.ctx, payload.PositionId, posInfo); err != nil {
+			logger.Error("could not save position", "err", err)
+			countError("LoadImg", "save_position")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		m.setPosition(payload.PositionId, posInfo)
+	}
+
+	preview, err := encodePreview(quantized.preview(colorProvider))
+	if err != nil {
+		logger.Error("could not encode preview", "err", err)
+		countError("LoadImg", "preview")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ImageLoadResult{payload.X, payload.Y, width, height, payload.PositionId, preview, false, nil})
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"maps"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := range w {
+		for y := range h {
+			img.Set(x, y, color.RGBA{uint8(x * 10), uint8(y * 10), 0, 255})
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(w, h)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Uploads the image as request body, the query holds the instructions
+func (srv *testServer) uploadImage(t *testing.T, token, query string, data []byte) (*http.Response, []byte) {
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/load-img?"+query, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("load-img: %v", err)
+		return nil, nil
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return res, body
+}
+
+func TestUploadImageFormats(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.login(t, "admin", RoleAdmin)
+	img := testImage(8, 6)
+
+	encoded := map[string][]byte{}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	encoded["png"] = bytes.Clone(buf.Bytes())
+	buf.Reset()
+	jpeg.Encode(&buf, img, nil)
+	encoded["jpeg"] = bytes.Clone(buf.Bytes())
+	buf.Reset()
+	gif.Encode(&buf, img, nil)
+	encoded["gif"] = bytes.Clone(buf.Bytes())
+	webp, err := os.ReadFile("testdata/gopher.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded["webp"] = webp
+
+	for format, data := range encoded {
+		res, body := srv.uploadImage(t, token, "x=0&y=0", data)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: got %d %q", format, res.StatusCode, body)
+			continue
+		}
+		var result ImageLoadResult
+		json.Unmarshal(body, &result)
+		preview, err := png.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(strings.TrimPrefix(result.Preview, "data:image/png;base64,"))))
+		if err != nil {
+			t.Errorf("%s: invalid preview: %v", format, err)
+			continue
+		}
+		if preview.Bounds().Dx() != result.W || preview.Bounds().Dy() != result.H {
+			t.Errorf("%s: preview is %v, image was drawn at %dx%d", format, preview.Bounds(), result.W, result.H)
+		}
+	}
+
+	if res, _ := srv.uploadImage(t, token, "x=0&y=0", []byte("not an image at all")); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("broken image: got %d, want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestUploadImageAsMultipartForm(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.login(t, "admin", RoleAdmin)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("x", "5")
+	form.WriteField("y", "-5")
+	form.WriteField("w", "10")
+	form.WriteField("positionId", "uploaded")
+	f, _ := form.CreateFormFile("image", "img.png")
+	f.Write(testPNG(t, 20, 10))
+	form.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/load-img", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var result ImageLoadResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d: %v", res.StatusCode, err)
+	}
+	if result.X != 5 || result.Y != -5 || result.W != 10 || result.H != 5 {
+		t.Errorf("got %+v", result)
+	}
+	if pos, ok := srv.manager.canvas().positions["uploaded"]; !ok || pos.ImageInfo.W != 10 {
+		t.Errorf("position wasn't registered: %+v", pos)
+	}
+}
+
+func TestLargeMultipartUploadLeavesNoTempFiles(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	srv := newTestServer(t)
+	token := srv.login(t, "admin", RoleAdmin)
+
+	// Noise doesn't compress, so the file is spooled to disk
+	noise := image.NewRGBA(image.Rect(0, 0, 700, 700))
+	rand.New(rand.NewSource(1)).Read(noise.Pix)
+	for i := 3; i < len(noise.Pix); i += 4 {
+		noise.Pix[i] = 255
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	f, _ := form.CreateFormFile("image", "noise.png")
+	png.Encode(f, noise)
+	form.Close()
+	if body.Len() <= 1<<20 {
+		t.Fatalf("upload has only %d bytes", body.Len())
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/load-img", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", res.StatusCode)
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("left %d temp files behind", len(entries))
+	}
+}
+
+func TestUploadImageLimits(t *testing.T) {
+	cfg := testConfig()
+	cfg.Images.MaxPixels = 300
+	cfg.Images.MaxUploadBytes = 4000
+	srv := newTestServerWithConfig(t, cfg)
+	token := srv.login(t, "admin", RoleAdmin)
+
+	for name, tc := range map[string]struct {
+		query string
+		data  []byte
+		want  int
+	}{
+		"within limits":      {"", testPNG(t, 10, 10), http.StatusOK},
+		"too many pixels":    {"", testPNG(t, 20, 20), http.StatusRequestEntityTooLarge},
+		"too many bytes":     {"", bytes.Repeat([]byte{0}, 5000), http.StatusRequestEntityTooLarge},
+		"scaled too far":     {"w=100", testPNG(t, 10, 10), http.StatusBadRequest},
+		"unknown metric":     {"metric=hsv", testPNG(t, 10, 10), http.StatusBadRequest},
+		"unknown resampling": {"w=5&resample=lanczos", testPNG(t, 10, 10), http.StatusBadRequest},
+		"invalid dry run":    {"dryRun=maybe", testPNG(t, 10, 10), http.StatusBadRequest},
+	} {
+		if res, body := srv.uploadImage(t, token, tc.query, tc.data); res.StatusCode != tc.want {
+			t.Errorf("%s: got %d %q, want %d", name, res.StatusCode, body, tc.want)
+		}
+	}
+}
+
+func TestLoadImageFromDirectory(t *testing.T) {
+	cfg := testConfig()
+	cfg.Images.Dir = t.TempDir()
+	srv := newTestServerWithConfig(t, cfg)
+	token := srv.login(t, "admin", RoleAdmin)
+
+	os.WriteFile(filepath.Join(cfg.Images.Dir, "inside.png"), testPNG(t, 4, 4), 0o644)
+	outside := filepath.Join(t.TempDir(), "outside.png")
+	os.WriteFile(outside, testPNG(t, 4, 4), 0o644)
+	os.Symlink(outside, filepath.Join(cfg.Images.Dir, "link.png"))
+
+	for path, want := range map[string]int{
+		"inside.png":                   http.StatusOK,
+		"/inside.png":                  http.StatusOK,
+		"link.png":                     http.StatusBadRequest,
+		outside:                        http.StatusBadRequest,
+		"../" + filepath.Base(outside): http.StatusBadRequest,
+	} {
+		if status, body := srv.post(t, "/load-img", token, ImgLoadInstructions{Path: path}); status != want {
+			t.Errorf("%s: got %d %q, want %d", path, status, body, want)
+		}
+	}
+}
+
+func TestLoadImageInstructionsWithoutContentType(t *testing.T) {
+	cfg := testConfig()
+	cfg.Images.Dir = t.TempDir()
+	srv := newTestServerWithConfig(t, cfg)
+	token := srv.login(t, "admin", RoleAdmin)
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{0xea, 0x62, 0x62, 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	os.WriteFile(filepath.Join(cfg.Images.Dir, "img.png"), buf.Bytes(), 0o644)
+	red, _ := srv.manager.canvas().colorProvider.ClosestColor(NewColor(0xea, 0x62, 0x62), MetricRGB)
+
+	for i, contentType := range []string{"", "text/plain; charset=utf-8"} {
+		body := fmt.Sprintf(` {"path": "img.png", "x": %d, "y": 0, "w": 2, "h": 2}`, i*10)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/load-img", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("content type %q: got %d %q", contentType, res.StatusCode, msg)
+		}
+	}
+	// Both were drawn where the instructions said, at the requested size
+	region, err := srv.manager.regionColors(srv.manager.canvas(), Area{Point{0, 0}, Point{13, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := range 3 {
+		for x := range 13 {
+			drawn := y < 2 && (x < 2 || x == 10 || x == 11)
+			if got := region.ids[y*13+x]; (got == red) != drawn {
+				t.Errorf("(%d, %d) has color %d, drawn: %v", x, y, got, drawn)
+			}
+		}
+	}
+}
+
+func TestLoadImageFromFileIsDisabledByDefault(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.login(t, "admin", RoleAdmin)
+	path := filepath.Join(t.TempDir(), "img.png")
+	os.WriteFile(path, testPNG(t, 4, 4), 0o644)
+
+	status, body := srv.post(t, "/load-img", token, ImgLoadInstructions{Path: path})
+	if status != http.StatusBadRequest || !strings.Contains(body, "upload") {
+		t.Errorf("got %d %q", status, body)
+	}
+}
+
+func TestUploadImageBlendsWithCanvas(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.login(t, "admin", RoleAdmin)
+	canvas := srv.manager.canvas()
+	cp := canvas.colorProvider
+	dark, _ := cp.ClosestColor(NewColor(0x1f, 0x10, 0x2a), MetricRGB)
+	red, _ := cp.ClosestColor(NewColor(0xea, 0x62, 0x62), MetricRGB)
+	halfWhite, _ := cp.ClosestColor(NewColor(0x8f, 0x88, 0x95), MetricRGB)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	img.SetNRGBA(1, 0, color.NRGBA{0xea, 0x62, 0x62, 255})
+	img.SetNRGBA(2, 0, color.NRGBA{255, 255, 255, 128})
+	img.SetNRGBA(3, 0, color.NRGBA{255, 255, 255, 10})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	// Drawn opaque as they are when replacing
+	translucent, _ := cp.ClosestColor(FromColor(img.At(2, 0)), MetricRGB)
+
+	for query, want := range map[string][]int{
+		"alpha=blend":   {dark, red, halfWhite, dark},
+		"alpha=replace": {0, red, translucent, 0},
+	} {
+		srv.manager.PutQuantized(&quantizedImage{4, 1, []int{dark, dark, dark, dark}}, 0, 0)
+		if res, body := srv.uploadImage(t, token, "x=0&y=0&"+query, buf.Bytes()); res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got %d %q", query, res.StatusCode, body)
+		}
+		region, err := srv.manager.regionColors(canvas, Area{Point{0, 0}, Point{4, 1}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(region.ids, want) {
+			t.Errorf("%s: got %v, want %v", query, region.ids, want)
+		}
+	}
+}
+
+func TestDryRunOnlyPreviewsChanges(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.login(t, "admin", RoleAdmin)
+	canvas := srv.manager.canvas()
+	// Two columns on each side of a section border
+	left, _ := canvas.sectionAt(-502, 0)
+	right, _ := canvas.sectionAt(-500, 0)
+	area := Area{Point{-502, 0}, Point{-498, 2}}
+	before, err := srv.manager.regionColors(canvas, area)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dryRun := func(want map[string]int) {
+		t.Helper()
+		res, body := srv.uploadImage(t, token, "x=-502&y=0&positionId=dry&dryRun=true", testPNG(t, 4, 2))
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("got %d %q", res.StatusCode, body)
+		}
+		var result ImageLoadResult
+		json.Unmarshal(body, &result)
+		if !result.DryRun || !maps.Equal(result.Changes, want) {
+			t.Errorf("got %+v, want changes %v", result, want)
+		}
+		preview, err := png.Decode(base64.NewDecoder(base64.StdEncoding, strings.NewReader(strings.TrimPrefix(result.Preview, "data:image/png;base64,"))))
+		if err != nil || preview.Bounds().Dx() != 4 || preview.Bounds().Dy() != 2 {
+			t.Errorf("invalid preview: %v", err)
+		}
+	}
+
+	dryRun(map[string]int{left.meta.Id: 4, right.meta.Id: 4})
+	after, _ := srv.manager.regionColors(canvas, area)
+	if !slices.Equal(before.ids, after.ids) {
+		t.Errorf("dry run changed the canvas: %v, was %v", after.ids, before.ids)
+	}
+	if _, ok := srv.manager.canvas().positions["dry"]; ok {
+		t.Error("dry run registered the position")
+	}
+
+	if res, body := srv.uploadImage(t, token, "x=-502&y=0", testPNG(t, 4, 2)); res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d %q", res.StatusCode, body)
+	}
+	dryRun(map[string]int{left.meta.Id: 0, right.meta.Id: 0})
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
-	"log"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,17 +15,32 @@ import (
 	_ "image/png"
 )
 
-// TODO: This assumes that JWT_SECRET is set as an environment variable. If it isn't,
-// os.Getenv will return an empty string. This feels a bit sketchy -> Look into this again.
-var secretKey = []byte(os.Getenv("JWT_SECRET"))
+// The role is taken from the token, changes to it apply once the token is refreshed
+type Claims struct {
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+	jwt.RegisteredClaims
+}
 
-func createToken(username string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"username": username,
-		"exp":      time.Now().Add(time.Hour * 1).Unix(),
+// The only algorithm tokens are signed and accepted with
+var signingMethod = jwt.SigningMethodHS256
+
+func createToken(cfg *Config, user User) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(signingMethod, Claims{
+		Username: user.Username,
+		Role:     user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        newId(),
+			Subject:   user.Username,
+			Issuer:    cfg.Auth.Issuer,
+			Audience:  jwt.ClaimStrings{cfg.Auth.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(cfg.Auth.AccessTokenTTL)),
+		},
 	})
 
-	tokenString, err := token.SignedString(secretKey)
+	tokenString, err := token.SignedString([]byte(cfg.JWTSecret))
 	if err != nil {
 		return "", err
 	}
@@ -33,179 +48,225 @@ func createToken(username string) (string, error) {
 	return tokenString, nil
 }
 
-func verifyToken(tokenString string) error {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil // TODO: come back to this
-	})
+// Checks signature, algorithm, issuer, audience and expiry. Whether the token
+// was revoked is up to the caller.
+func verifyToken(cfg *Config, tokenString string) (*Claims, error) {
+	var claims Claims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		return []byte(cfg.JWTSecret), nil
+	},
+		jwt.WithValidMethods([]string{signingMethod.Alg()}),
+		jwt.WithIssuer(cfg.Auth.Issuer),
+		jwt.WithAudience(cfg.Auth.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if !token.Valid {
-		return fmt.Errorf("invalid token")
+	if !token.Valid || claims.ID == "" {
+		return nil, fmt.Errorf("invalid token")
 	}
 
-	return nil
+	return &claims, nil
 }
 
 func LoginHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
 	w.Header().Set("Content-Type", "text/plain")
 
-	var u User
-	json.NewDecoder(r.Body).Decode(&u)
-	log.Printf("user trying to log in: '%s' '%s'", u.Username, u.Password)
-
-	userInDb, err := m.LoadUser(u.Username)
+	var creds Credentials
+	json.NewDecoder(r.Body).Decode(&creds)
+	logger := loggerFrom(r.Context()).With("user", creds)
+	logger.Info("user trying to log in")
+	if ok, wait := m.takeAuthLimit(r, creds.Username); !ok {
+		logger.Warn("too many login attempts")
+		countError("LoginHandler", "rate_limited")
+		writeRateLimited(w, wait)
+		return
+	}
 
-	if err == nil && u.Username == userInDb.Username && u.Password == userInDb.Password {
-		tokenString, err := createToken(u.Username)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Println("Could not create token for username", u.Username)
-		}
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, tokenString)
-	} else {
-		if err != nil {
-			log.Println("error during auth:", err)
+	user, err := m.authenticate(creds.Username, creds.Password)
+	if err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			logger.Info("error during auth: invalid credentials")
+			countError("LoginHandler", "invalid_credentials")
 		} else {
-			log.Println("error during auth: invalid credentials")
+			logger.Info("error during auth", "err", err)
+			countError("LoginHandler", "load_user")
 		}
 		w.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprint(w, "Invalid credentials")
-	}
-}
-
-func AuthorizedHandler(w http.ResponseWriter, r *http.Request, manager *Manager, handler func(http.ResponseWriter, *http.Request, *Manager)) {
-	w.Header().Set("Content-Type", "text/plain")
-	tokenString := r.Header.Get("Authorization")
-	if tokenString == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, "Missing authorization header")
 		return
 	}
-	tokenString = tokenString[len("Bearer "):]
 
-	err := verifyToken(tokenString)
+	tokens, err := m.issueTokens(user, time.Now().Add(m.config.Auth.RefreshTokenTTL))
 	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, "Invalid token")
+		w.WriteHeader(http.StatusInternalServerError)
+		logger.Error("could not create token", "err", err)
+		countError("LoginHandler", "create_token")
 		return
 	}
-
-	handler(w, r, manager)
+	writeTokens(w, tokens)
 }
 
-type ImgLoadInstructions struct {
-	Path       string `json:"path"`
-	X          int    `json:"x"`
-	Y          int    `json:"y"`
-	W          int    `json:"w"`
-	H          int    `json:"h"`
-	PositionId string `json:"positionId"`
-}
+// Any valid token (or API key) will do
+const anyRole Permission = ""
 
-type PositionImageInfo struct {
-	TopLeft Point `json:"topLeft"`
-	W       int   `json:"w"`
-	H       int   `json:"h"`
-}
-
-type PositionInfo struct {
-	Center    Point             `json:"center"`
-	ImageInfo PositionImageInfo `json:"imageInfo"`
-}
+var (
+	ErrMissingCredentials = errors.New("missing credentials")
+	ErrInvalidToken       = errors.New("invalid token")
+)
 
-func getImageFromFilePath(filePath string) (image.Image, error) {
-	f, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
+// The access token or API key of a request. Browsers can't set headers on
+// websocket connections, those may pass them in the query instead.
+func requestCredentials(r *http.Request, allowQuery bool) string {
+	if value, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return value
 	}
-	defer f.Close()
-	image, _, err := image.Decode(f)
-	return image, err
+	if value := r.Header.Get("X-API-Key"); value != "" {
+		return value
+	}
+	if allowQuery {
+		if value := r.URL.Query().Get("access_token"); value != "" {
+			return value
+		}
+		return r.URL.Query().Get("api_key")
+	}
+	return ""
 }
 
-func LoadImg(w http.ResponseWriter, r *http.Request, m *Manager) {
-	decoder := json.NewDecoder(r.Body)
-	var payload ImgLoadInstructions
-	if err := decoder.Decode(&payload); err != nil {
-		log.Println("Could not decode ImgLoadInstructions", err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, err)
-		return
+// Returns either the claims of a valid, unrevoked access token or a valid API
+// key. Errors other than ErrMissingCredentials and ErrInvalidToken mean the
+// store couldn't be asked.
+func (m *Manager) authenticateRequest(r *http.Request, allowQuery bool) (*Claims, *APIKey, error) {
+	logger := loggerFrom(r.Context())
+	value := requestCredentials(r, allowQuery)
+	if value == "" {
+		countError("authenticate", "missing_header")
+		return nil, nil, ErrMissingCredentials
 	}
 
-	log.Printf("Loading image %s %d %d", payload.Path, payload.X, payload.Y)
+	if isAPIKey(value) {
+		key, err := m.verifyAPIKey(value)
+		if errors.Is(err, ErrInvalidToken) {
+			countError("authenticate", "invalid_api_key")
+		} else if err != nil {
+			logger.Error("could not load api key", "err", err)
+			countError("authenticate", "load_api_key")
+		}
+		return nil, key, err
+	}
 
-	image, err := getImageFromFilePath(payload.Path)
+	claims, err := verifyToken(m.config, value)
 	if err != nil {
-		log.Printf("Could not load image from path %s: %s", payload.Path, err)
-		w.WriteHeader(http.StatusBadRequest)
+		logger.Info("rejected token", "err", err)
+		countError("authenticate", "invalid_token")
+		return nil, nil, ErrInvalidToken
+	}
+	if revoked, err := m.store.TokenRevoked(*m.ctx, claims.ID); err != nil {
+		logger.Error("could not check token revocation", "err", err)
+		countError("authenticate", "revocation_check")
+		return nil, nil, err
+	} else if revoked {
+		countError("authenticate", "revoked_token")
+		return nil, nil, ErrInvalidToken
+	}
+	return claims, nil, nil
+}
+
+// Passes requests with a valid token whose role has the permission (or an API
+// key with the scope, within its rate limit) on to the handler, with the
+// token's claims or the key in the request context
+func AuthorizedHandler(w http.ResponseWriter, r *http.Request, manager *Manager, perm Permission, handler func(http.ResponseWriter, *http.Request, *Manager)) {
+	w.Header().Set("Content-Type", "text/plain")
+	claims, key, err := manager.authenticateRequest(r, false)
+	switch {
+	case errors.Is(err, ErrMissingCredentials):
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Missing authorization header")
+		return
+	case errors.Is(err, ErrInvalidToken):
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Invalid token")
+		return
+	case err != nil:
+		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
 
-	// resize image proportionally depending on either width or height, if specified
-	if payload.W != 0 && payload.W != image.Bounds().Dx() {
-		height := image.Bounds().Dy() * payload.W / image.Bounds().Dx()
-		image, err = ResizeImage(image, payload.W, height)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+	ctx := r.Context()
+	if key != nil {
+		if perm != anyRole && !key.Can(perm) {
+			loggerFrom(ctx).Warn("permission denied", "apiKey", key, "permission", perm)
+			countError("AuthorizedHandler", "forbidden")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Permission denied")
 			return
 		}
-	} else if payload.H != 0 && payload.H != image.Bounds().Dy() {
-		width := image.Bounds().Dx() * payload.H / image.Bounds().Dy()
-		image, err = ResizeImage(image, width, payload.H)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+		if ok, wait := manager.takeAPIKeyLimit(key, 1); !ok {
+			countError("AuthorizedHandler", "rate_limited")
+			writeRateLimited(w, wait)
 			return
 		}
-	}
-
-	m.PutImage(image, payload.X, payload.Y)
-
-	// register new positionId at center of img
-	if payload.PositionId != "" {
-		log.Println("Registering posId for loaded img:", payload.PositionId)
-		center := *NewPoint(
-			payload.X+image.Bounds().Dx()/2,
-			payload.Y+image.Bounds().Dy()/2,
-		)
-		topLeft := *NewPoint(payload.X, payload.Y)
-		posInfo := PositionInfo{center, PositionImageInfo{topLeft, image.Bounds().Dx(), image.Bounds().Dy()}}
-		bytes, err := json.Marshal(posInfo)
-		if err != nil {
-			log.Println("could not marshal position", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		ctx = withAPIKey(ctx, key)
+		ctx = withLogger(ctx, loggerFrom(ctx).With("apiKey", key))
+	} else {
+		if perm != anyRole && !claims.Role.Can(perm) {
+			loggerFrom(ctx).Warn("permission denied", "username", claims.Username, "role", claims.Role, "permission", perm)
+			countError("AuthorizedHandler", "forbidden")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Permission denied")
 			return
 		}
-		m.positions[payload.PositionId] = posInfo
-		m.redis.Set(*m.ctx, REDIS_KEYS.POSITION(payload.PositionId), bytes, 0)
-		m.redis.SAdd(*m.ctx, REDIS_KEYS.POS_IDS, payload.PositionId)
+		ctx = withClaims(ctx, claims)
+		ctx = withLogger(ctx, loggerFrom(ctx).With("username", claims.Username))
 	}
+
+	handler(w, r.WithContext(ctx), manager)
+}
+
+type PositionImageInfo struct {
+	TopLeft Point `json:"topLeft"`
+	W       int   `json:"w"`
+	H       int   `json:"h"`
+}
+
+type PositionInfo struct {
+	Center    Point             `json:"center"`
+	ImageInfo PositionImageInfo `json:"imageInfo"`
 }
 
 // deletes positionId and clears the associated image (if it exists) with default color
 func DeletePositionId(w http.ResponseWriter, r *http.Request, m *Manager) {
 	posId := r.URL.Query().Get("pos")
-	pos, posExists := m.positions[posId]
+	canvas := m.canvas()
+	pos, posExists := canvas.positions[posId]
 
 	if !posExists {
 		return
 	}
 
-	delete(m.positions, posId)
-	m.redis.Del(*m.ctx, REDIS_KEYS.POSITION(posId))
-	m.redis.SRem(*m.ctx, REDIS_KEYS.POS_IDS, posId)
+	if err := m.store.DeletePosition(*m.ctx, posId); err != nil {
+		loggerFrom(r.Context()).Error("could not delete position", "posId", posId, "err", err)
+		countError("DeletePositionId", "delete")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	m.removePosition(posId)
 
-	log.Printf("Deleting position with posId=%s : %v", posId, pos)
+	loggerFrom(r.Context()).Info("deleting position", "posId", posId, "position", pos)
 
 	// clear image from canvas
 	if pos.ImageInfo.W != 0 && pos.ImageInfo.H != 0 {
 		img := image.NewRGBA(image.Rect(0, 0, pos.ImageInfo.W, pos.ImageInfo.H))
-		draw.Draw(img, img.Bounds(), &image.Uniform{m.colorProvider.colors[0]}, image.Point{0, 0}, draw.Src)
-		m.PutImage(img, pos.ImageInfo.TopLeft.X, pos.ImageInfo.TopLeft.Y)
+		draw.Draw(img, img.Bounds(), &image.Uniform{canvas.colorProvider.colors[0]}, image.Point{0, 0}, draw.Src)
+		if err := m.PutImage(img, pos.ImageInfo.TopLeft.X, pos.ImageInfo.TopLeft.Y); err != nil {
+			loggerFrom(r.Context()).Error("could not clear image", "posId", posId, "err", err)
+			countError("DeletePositionId", "clear")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
 	}
 }
 
@@ -216,12 +277,18 @@ type ColorUpdate struct {
 }
 
 func UpdateColorsHandler(w http.ResponseWriter, r *http.Request, manager *Manager) {
+	logger := loggerFrom(r.Context())
 	var colorUpdate ColorUpdate
 	if err := json.NewDecoder(r.Body).Decode(&colorUpdate); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		log.Println("could not parse json color update")
+		logger.Warn("could not parse json color update", "err", err)
+		countError("UpdateColorsHandler", "decode")
 		return
 	}
 
-	manager.UpdateColors(colorUpdate)
+	if err := manager.UpdateColors(colorUpdate); err != nil {
+		logger.Error("could not update colors", "err", err)
+		countError("UpdateColorsHandler", "update")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	loggerContextKey contextKey = iota
+	claimsContextKey
+	apiKeyContextKey
+)
+
+// Sets up the default logger. `level` is one of debug, info, warn, error and
+// `format` is either text or json.
+func setupLogger(w io.Writer, level, format string) *slog.Logger {
+	// Validated with the config, the default is info
+	lvl, _ := parseLogLevel(level)
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	if strings.EqualFold(format, "json") {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+	return logger
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(s)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", s)
+	}
+	return lvl, nil
+}
+
+// Short random id used to correlate log lines of a connection or request
+func newId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// A string which never shows up in logs
+type Secret string
+
+func (Secret) LogValue() slog.Value {
+	return slog.StringValue("[REDACTED]")
+}
+
+func (s Secret) String() string {
+	return "[REDACTED]"
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Attaches a logger carrying a request id to the request context. An id passed
+// in via the X-Request-Id header (e.g. by traefik) is reused.
+func requestLoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqId := r.Header.Get("X-Request-Id")
+		if reqId == "" {
+			reqId = newId()
+		}
+		w.Header().Set("X-Request-Id", reqId)
+		logger := slog.Default().With("requestId", reqId)
+		logger.Debug("handling request", "method", r.Method, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(withLogger(r.Context(), logger)))
+	})
+}
@@ -1,74 +1,169 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"math"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
-	"github.com/redis/go-redis/v9"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func setupAPI() (*mux.Router, error) {
-	manager, err := NewManager(&redis.Options{
-		Addr:     "redis:6379",
-		Password: "",
-		DB:       0,
-	})
+func setupAPI(cfg *Config) (*mux.Router, *Manager, error) {
+	manager, err := NewManager(cfg)
 	if err != nil {
-		log.Println("failed to create manager", err)
-		return nil, err
+		slog.Error("failed to create manager", "err", err)
+		return nil, nil, err
 	}
 
 	r := mux.NewRouter()
-	r.HandleFunc("/ws", manager.ServeWS)
-	r.HandleFunc("/colors", manager.ServeColors)
-	r.HandleFunc("/sections", manager.ServeSectionsMeta)
-	r.HandleFunc("/section-data/{secId}", manager.ServeSectionData)
-	r.HandleFunc("/test", manager.Test)
-	r.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/healthz", manager.ServeHealthz)
+	r.HandleFunc("/readyz", manager.ServeReadyz)
+	r.Handle("/metrics", promhttp.Handler())
+
+	// Everything else needs the metadata from redis
+	api := r.NewRoute().Subrouter()
+	api.Use(manager.requireLoaded)
+	api.HandleFunc("/ws", manager.ServeWS)
+	api.HandleFunc("/colors", manager.ServeColors)
+	api.HandleFunc("/sections", manager.ServeSectionsMeta)
+	api.HandleFunc("/section-data/{secId}", manager.ServeSectionData)
+	api.HandleFunc("/test", manager.Test)
+	api.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
 		LoginHandler(w, r, manager)
 	})
-	r.HandleFunc("/load-img", func(w http.ResponseWriter, r *http.Request) {
-		AuthorizedHandler(w, r, manager, LoadImg)
+	api.HandleFunc("/refresh", func(w http.ResponseWriter, r *http.Request) {
+		RefreshHandler(w, r, manager)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, anyRole, LogoutHandler)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		RegisterHandler(w, r, manager)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/change-password", func(w http.ResponseWriter, r *http.Request) {
+		ChangePasswordHandler(w, r, manager)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/load-img", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermLoadImage, adminJob(LoadImg))
 	})
-	r.HandleFunc("/delete-pos-id", func(w http.ResponseWriter, r *http.Request) {
-		AuthorizedHandler(w, r, manager, DeletePositionId)
+	api.HandleFunc("/delete-pos-id", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermModerate, adminJob(DeletePositionId))
 	})
-	r.HandleFunc("/update-colors", func(w http.ResponseWriter, r *http.Request) {
-		AuthorizedHandler(w, r, manager, UpdateColorsHandler)
+	api.HandleFunc("/update-colors", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermManagePalette, adminJob(UpdateColorsHandler))
 	})
+	api.HandleFunc("/user-role", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermManageUsers, SetRoleHandler)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/pixels", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermPlace, PutPixelsHandler)
+	}).Methods(http.MethodPut)
+	api.HandleFunc("/pixel", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermRead, GetPixelHandler)
+	}).Methods(http.MethodGet)
+	api.HandleFunc("/region", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermRead, GetRegionHandler)
+	}).Methods(http.MethodGet)
+	api.HandleFunc("/api-keys", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermManageUsers, ListAPIKeysHandler)
+	}).Methods(http.MethodGet)
+	api.HandleFunc("/api-keys", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermManageUsers, CreateAPIKeyHandler)
+	}).Methods(http.MethodPost)
+	api.HandleFunc("/api-keys/{id}", func(w http.ResponseWriter, r *http.Request) {
+		AuthorizedHandler(w, r, manager, PermManageUsers, RevokeAPIKeyHandler)
+	}).Methods(http.MethodDelete)
 
-	//initRedisFromScratch(manager)
-	for {
-		err := manager.LoadFromRedis()
-		if err == nil {
-			break
-		}
-		log.Println(err)
-		log.Println("Can't load data from redis. Retrying in 2 seconds...")
-		time.Sleep(2 * time.Second)
+	// Local stores start out empty
+	if store, ok := manager.store.(emptyChecker); ok && store.Empty() {
+		initStoreFromScratch(manager)
 	}
-	log.Println("Successfully loaded data from redis.")
-
-	go manager.ListenForEvents()
+	//initStoreFromScratch(manager)
+	// Loads the data and starts the event loop as soon as the store is reachable
+	go manager.MonitorStore()
+	go manager.ExpireSessions()
 
-	return r, nil
+	return r, manager, nil
 }
 
 func main() {
-	router, err := setupAPI()
+	cfg, err := LoadConfig()
 	if err != nil {
-		log.Println("failed to setup api")
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	setupLogger(os.Stderr, cfg.Log.Level, cfg.Log.Format)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, cfg, os.Args[1], os.Args[2:]); err != nil {
+			slog.Error("command failed", "command", os.Args[1], "err", err)
+			os.Exit(1)
+		}
 		return
 	}
-	http.Handle("/", router)
-	log.Fatal(http.ListenAndServe(":5000", nil))
+
+	router, manager, err := setupAPI(cfg)
+	if err != nil {
+		slog.Error("failed to setup api")
+		os.Exit(1)
+	}
+
+	server := &http.Server{
+		Addr:    cfg.ListenAddr,
+		Handler: requestLoggingMiddleware(router),
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", cfg.ListenAddr)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		slog.Error("server stopped", "err", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("received signal, shutting down", "timeout", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	// Stop accepting connections right away; in-flight requests are waited for in the background
+	httpDone := make(chan error, 1)
+	go func() { httpDone <- server.Shutdown(shutdownCtx) }()
+
+	exitCode := 0
+	if err := manager.Shutdown(shutdownCtx); err != nil {
+		slog.Error("could not shut down manager cleanly", "err", err)
+		exitCode = 1
+	}
+	if err := <-httpDone; err != nil {
+		slog.Error("could not shut down http server cleanly", "err", err)
+		exitCode = 1
+	}
+	if err := manager.Close(); err != nil {
+		slog.Error("could not close store", "err", err)
+		exitCode = 1
+	}
+	slog.Info("shutdown complete")
+	os.Exit(exitCode)
 }
 
-func initRedisFromScratch(m *Manager) {
-	m.redis.FlushDB(*m.ctx)
+func initStoreFromScratch(m *Manager) {
+	if err := m.store.Reset(*m.ctx); err != nil {
+		slog.Error("failed to reset store", "err", err)
+		return
+	}
 	bitsPerColor := 6
 	nrCols := 5
 	nrRows := 5
@@ -92,29 +187,32 @@ func initRedisFromScratch(m *Manager) {
 	colorProvider := NewColorProvider(bitsPerColor, colors...)
 	positions := make(map[string]PositionInfo)
 	positions["example"] = PositionInfo{*NewPoint(100, 200), PositionImageInfo{}}
-	log.Printf("%d sections\n", len(sections))
-	log.Printf("%d colors\n", len(colorProvider.colors))
-	log.Printf("%d positions\n", len(positions))
+	slog.Info("initializing store", "sections", len(sections), "colors", len(colorProvider.colors), "positions", len(positions))
 
-	m.sections = sections
-	m.colorProvider = colorProvider
-	m.positions = positions
+	m.updateCanvas(func(c *Canvas) {
+		c.sections = sections
+		c.colorProvider = colorProvider
+		c.positions = positions
+	})
 	if err := m.SaveSectionsMeta(); err != nil {
-		log.Println("failed to save sections meta", err)
+		slog.Error("failed to save sections meta", "err", err)
 	}
 	if err := m.SaveColorProvider(); err != nil {
-		log.Println("failed to save color provider", err)
+		slog.Error("failed to save color provider", "err", err)
 	}
 	if err := m.SavePositions(); err != nil {
-		log.Println("failed to save positions", err)
+		slog.Error("failed to save positions", "err", err)
 	}
 	initSectionData(m)
 }
 
 func initSectionData(m *Manager) {
-	for _, section := range m.sections {
+	canvas := m.canvas()
+	for _, section := range canvas.sections {
 		nrPixels := (section.meta.BotRight.X - section.meta.TopLeft.X) * (section.meta.BotRight.Y - section.meta.TopLeft.Y)
-		nrBits := nrPixels * m.colorProvider.bitsPerColor
-		m.redis.SetBit(*m.ctx, REDIS_KEYS.SEC_PIX_DATA(section.meta.Id), int64(nrBits-1), 0)
+		nrBits := nrPixels * canvas.colorProvider.bitsPerColor
+		if err := m.store.SaveSectionData(*m.ctx, section.meta.Id, make([]byte, (nrBits+7)/8)); err != nil {
+			slog.Error("failed to save section data", "secId", section.meta.Id, "err", err)
+		}
 	}
 }
@@ -6,14 +6,14 @@ import (
 	"errors"
 	"fmt"
 	"image"
-	"log"
+	"log/slog"
 	"net/http"
+	"slices"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	"github.com/redis/go-redis/v9"
 )
 
 var (
@@ -21,202 +21,169 @@ var (
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
-	ErrUnknownEvent = errors.New("unknown event type")
+	ErrUnknownEvent   = errors.New("unknown event type")
+	ErrShuttingDown   = errors.New("server is shutting down")
+	ErrUnknownSection = errors.New("unknown section")
+	ErrForbidden      = errors.New("permission denied")
+	ErrOutsideArea    = errors.New("pixel outside the area of the API key")
+	ErrRateLimited    = errors.New("rate limit exceeded")
+	ErrInvalidPixel   = errors.New("pixel index or color out of range")
 )
 
 type ClientRequest struct {
 	c       *Client
 	request *SocketEvent
+	logger  *slog.Logger
 }
 
 type Manager struct {
 	sync.RWMutex
-	clients        ClientList
-	clientRequests chan ClientRequest
-	eventHandlers  map[string]EventHandler
-	redis          *redis.Client
-	pubsub         *redis.PubSub
-	ctx            *context.Context
-	sectionSubs    map[string]map[*Client]struct{}
-	sections       []*Section
-	positions      map[string]PositionInfo
-	colorProvider  *ColorProvider
+	config        *Config
+	clients       ClientList
+	requests      *workerPool
+	eventHandlers map[string]EventHandler
+	store         CanvasStore
+	channelsMu    sync.Mutex
+	channelRefs   map[string]int // secId -> local clients and detached sessions subscribed to it
+	ctx           *context.Context
+	sectionSubs   map[string]map[*Client]struct{}
+	canvasState   atomic.Pointer[Canvas]
+	canvasMu      sync.Mutex   // serializes canvas updates
+	paintMu       sync.RWMutex // pixel writes (read) vs. re-encoding the sections for a new palette (write)
+	sessions      *Sessions
+	rateLimits    *rateLimiters // of API keys and users
+	ready         readiness
+	shuttingDown  bool
+	eventsRunning bool
+	stopEvents    chan struct{}
+	eventsStopped chan struct{}
+	readers       sync.WaitGroup // ReadUserMsgs goroutines
+	jobs          sync.WaitGroup // admin jobs (image loads, color updates, ...)
 }
 
 func (m *Manager) loadSectionsMeta() error {
-	// Section Ids
-	sectionIds, err := m.redis.SMembers(*m.ctx, REDIS_KEYS.SEC_IDS).Result()
+	sectionsMeta, err := m.store.SectionsMeta(*m.ctx)
 	if err != nil {
-		log.Printf("error when getting key %s %v\n", REDIS_KEYS.SEC_IDS, err)
 		return err
 	}
-	log.Printf("loading %d sections", len(sectionIds))
-	sections := make([]*Section, len(sectionIds))
-	// Section meta data
-	for i, id := range sectionIds {
-		binary, err := m.redis.Get(*m.ctx, REDIS_KEYS.SEC_META(id)).Bytes()
-		if err != nil {
-			log.Printf("error when getting key %s %v\n", REDIS_KEYS.SEC_META(id), err)
-			return err
-		}
-		var sectionMeta = SectionMetaData{}
-		if err := json.Unmarshal(binary, &sectionMeta); err != nil {
-			log.Println("could not unmarshal", err)
-			return err
-		}
-		section := NewSection(&sectionMeta, nil)
-		sections[i] = section
-		m.sectionSubs[section.meta.Id] = make(map[*Client]struct{})
+	slog.Info("loading sections", "count", len(sectionsMeta))
+	sections := make([]*Section, len(sectionsMeta))
+	for i := range sectionsMeta {
+		sections[i] = NewSection(&sectionsMeta[i], nil)
 	}
 
-	m.sections = sections
+	// Reloads keep the subscribers of known sections
+	m.Lock()
+	for _, section := range sections {
+		if _, ok := m.sectionSubs[section.meta.Id]; !ok {
+			m.sectionSubs[section.meta.Id] = make(map[*Client]struct{})
+		}
+	}
+	m.Unlock()
+	m.updateCanvas(func(c *Canvas) { c.sections = sections })
 
 	return nil
 }
 
 func (m *Manager) SaveSectionsMeta() error {
-	m.redis.Del(*m.ctx, REDIS_KEYS.SEC_IDS)
-	for _, section := range m.sections {
-		bytes, err := json.Marshal(section.meta)
-		if err != nil {
-			log.Println("could not marshal section meta data", err)
-			return err
-		}
-		m.redis.Set(*m.ctx, REDIS_KEYS.SEC_META(section.meta.Id), bytes, 0)
-		m.redis.SAdd(*m.ctx, REDIS_KEYS.SEC_IDS, section.meta.Id)
-	}
-	return nil
+	sectionsMeta := m.canvas().sectionsMetaData()
+	return m.store.SaveSectionsMeta(*m.ctx, sectionsMeta)
 }
 
 func (m *Manager) loadPositions() error {
-	log.Println("loading positions")
-	positionIds, err := m.redis.SMembers(*m.ctx, REDIS_KEYS.POS_IDS).Result()
+	positions, err := m.store.Positions(*m.ctx)
 	if err != nil {
-		log.Printf("error when getting key %s %v\n", REDIS_KEYS.POS_IDS, err)
 		return err
 	}
-	log.Printf("loading %d positions", len(positionIds))
-	positions := make(map[string]PositionInfo)
-	for _, id := range positionIds {
-		binary, err := m.redis.Get(*m.ctx, REDIS_KEYS.POSITION(id)).Bytes()
-		if err != nil {
-			log.Printf("error when getting key %s %v\n", REDIS_KEYS.SEC_META(id), err)
-			return err
-		}
-		var info = PositionInfo{}
-		if err := json.Unmarshal(binary, &info); err != nil {
-			log.Println("could not unmarshal", err)
-			return err
-		}
-		positions[id] = info
-	}
+	slog.Info("loading positions", "count", len(positions))
 
-	m.positions = positions
+	m.updateCanvas(func(c *Canvas) { c.positions = positions })
 	return nil
 }
 
 func (m *Manager) SavePositions() error {
-	m.redis.Del(*m.ctx, REDIS_KEYS.POS_IDS)
-	for id, pos := range m.positions {
-		bytes, err := json.Marshal(pos)
-		if err != nil {
-			log.Println("could not marshal position", err)
+	for id, pos := range m.canvas().positions {
+		if err := m.store.SavePosition(*m.ctx, id, pos); err != nil {
+			slog.Error("could not save position", "posId", id, "err", err)
 			return err
 		}
-		m.redis.Set(*m.ctx, REDIS_KEYS.POSITION(id), bytes, 0)
-		m.redis.SAdd(*m.ctx, REDIS_KEYS.POS_IDS, id)
 	}
 	return nil
 }
 
 func (m *Manager) loadColorProvider() error {
-	log.Println("loading color provider")
-	bitsPerColor, err := m.redis.Get(*m.ctx, REDIS_KEYS.BITS_PER_COLOR).Int()
-	if err != nil {
-		log.Println("error when getting key ", err)
-		return err
-	}
-	colorSet, err := m.redis.SMembers(*m.ctx, REDIS_KEYS.COLOR_SET).Result()
+	bitsPerColor, colorChoices, err := m.store.Palette(*m.ctx)
 	if err != nil {
-		log.Println("error when getting key ", err)
 		return err
 	}
-	log.Printf("loading %d colors", len(colorSet))
-
-	m.colorProvider = NewColorProvider(bitsPerColor)
+	slog.Info("loading colors", "count", len(colorChoices))
 
-	for _, binary := range colorSet {
-		var colorChoice ColorChoice
-		if err := json.Unmarshal([]byte(binary), &colorChoice); err != nil {
-			log.Println("Could not unmarshal color:", err)
-			continue
-		}
+	colorProvider := NewColorProvider(bitsPerColor)
+	for _, colorChoice := range colorChoices {
 		color := &Color{byte(colorChoice.Rgb[0]), byte(colorChoice.Rgb[1]), byte(colorChoice.Rgb[2]), 255}
-		m.colorProvider.colors[colorChoice.Id] = color
-		m.colorProvider.ids[color] = colorChoice.Id
-		m.colorProvider.order[colorChoice.Id] = colorChoice.Order
+		colorProvider.colors[colorChoice.Id] = color
+		colorProvider.ids[color] = colorChoice.Id
+		colorProvider.order[colorChoice.Id] = colorChoice.Order
 	}
+	m.updateCanvas(func(c *Canvas) { c.colorProvider = colorProvider })
 
 	return nil
 }
 
 func (m *Manager) SaveColorProvider() error {
-	m.redis.Del(*m.ctx, REDIS_KEYS.COLOR_SET)
-	m.redis.Set(*m.ctx, REDIS_KEYS.BITS_PER_COLOR, m.colorProvider.bitsPerColor, 0)
-	for id, color := range m.colorProvider.colors {
-		colorChoice := ColorChoice{id, m.colorProvider.order[id], []int{int(color.R), int(color.G), int(color.B)}}
-		bytes, err := json.Marshal(colorChoice)
-		if err != nil {
-			log.Println("could not marshal color", err)
-			return err
-		}
-		m.redis.SAdd(*m.ctx, REDIS_KEYS.COLOR_SET, bytes)
-	}
+	return m.saveColorProvider(m.canvas().colorProvider)
+}
 
-	return nil
+func (m *Manager) saveColorProvider(colorProvider *ColorProvider) error {
+	return m.store.SavePalette(*m.ctx, colorProvider.bitsPerColor, colorProvider.choices())
 }
 
-func NewManager(redisOptions *redis.Options) (*Manager, error) {
-	rdb := redis.NewClient(redisOptions)
+func NewManager(cfg *Config) (*Manager, error) {
+	store, err := NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	ctx := context.Background()
 
-	for err := rdb.Ping(ctx).Err(); err != nil; {
-		log.Println("Can't connect to redis. Retrying in 2 seconds...: ", err)
-		rdb.Close()
-		time.Sleep(2 * time.Second)
-		rdb = redis.NewClient(redisOptions)
-	}
-	log.Println("Successfully connected to redis.")
-
 	m := &Manager{
-		clients:        make(ClientList),
-		clientRequests: make(chan ClientRequest, 1),
-		eventHandlers:  make(map[string]EventHandler),
-		redis:          rdb,
-		ctx:            &ctx,
-		sectionSubs:    make(map[string]map[*Client]struct{}),
-	}
-
-	m.pubsub = m.redis.Subscribe(*m.ctx, "set_pixel")
+		config:        cfg,
+		clients:       make(ClientList),
+		eventHandlers: make(map[string]EventHandler),
+		store:         store,
+		ctx:           &ctx,
+		sectionSubs:   make(map[string]map[*Client]struct{}),
+		channelRefs:   make(map[string]int),
+		rateLimits:    newRateLimiters(),
+		stopEvents:    make(chan struct{}),
+		eventsStopped: make(chan struct{}),
+	}
+
+	m.canvasState.Store(emptyCanvas())
+	m.requests = newWorkerPool(cfg.Websocket.RequestWorkers, cfg.Websocket.RequestQueueSize, m.processClientRequest)
+	m.sessions = NewSessions(cfg.Websocket.ResumeWindow, cfg.Websocket.ResumeBufferSize, m.releaseSections)
 
 	m.setupEventHandlers()
 	return m, nil
 }
 
-func (m *Manager) LoadFromRedis() error {
+func (m *Manager) LoadFromStore() error {
+	if err := m.store.Open(*m.ctx); err != nil {
+		return err
+	}
+
 	if err := m.loadSectionsMeta(); err != nil {
-		log.Println("could not load sections", err)
+		slog.Error("could not load sections", "err", err)
 		return err
 	}
 
 	if err := m.loadColorProvider(); err != nil {
-		log.Println("could not load color provider", err)
+		slog.Error("could not load color provider", "err", err)
 		return err
 	}
 
 	if err := m.loadPositions(); err != nil {
-		log.Println("could not load positions", err)
+		slog.Error("could not load positions", "err", err)
 		return err
 	}
 
@@ -224,20 +191,19 @@ func (m *Manager) LoadFromRedis() error {
 }
 
 // TODO: worry about performance (set row-wise / pipe requests?)
-func (m *Manager) SetPixelsInSection(secMeta SectionMetaData, secX, secY, w, h int, img image.Image, imgX int, imgY int) error {
+func (m *Manager) SetPixelsInSection(secMeta SectionMetaData, secX, secY, w, h int, img *quantizedImage, imgX int, imgY int) error {
 	// set row by row
 	secWidth := secMeta.BotRight.X - secMeta.TopLeft.X
 	for row := range h {
 		// Slice into image
 		for col := range w {
-			color := img.At(imgX+col, imgY+row)
-			// Translate into closest available color
-			colorIdToUse, err := m.colorProvider.ClosestAvailableColor(FromColor(color))
-			//fmt.Println(colorIdToUse)
-			if err != nil {
+			colorIdToUse := img.at(imgX+col, imgY+row)
+			if colorIdToUse == keepPixel {
+				continue
+			}
+			if err := m.SetPixel(SetPixelData{SecId: secMeta.Id, PixIdx: (secY+row)*secWidth + (secX + col), ColorId: colorIdToUse}); err != nil {
 				return err
 			}
-			m.SetPixel(SetPixelData{SecId: secMeta.Id, PixIdx: (secY+row)*secWidth + (secX + col), ColorId: colorIdToUse})
 		}
 		//rowY := row + secY
 		//m.redis.BitField()
@@ -245,29 +211,39 @@ func (m *Manager) SetPixelsInSection(secMeta SectionMetaData, secX, secY, w, h i
 	return nil
 }
 
-func (m *Manager) PutImage(img image.Image, x int, y int) {
+// Draws the image in the colors of the palette closest to its own
+func (m *Manager) PutImage(img image.Image, x int, y int) error {
+	q, err := quantize(img, m.canvas().colorProvider, quantizeOptions{dither: DitherNone, metric: m.config.Images.ColorMetric})
+	if err != nil {
+		return err
+	}
+	m.PutQuantized(q, x, y)
+	return nil
+}
+
+func (m *Manager) PutQuantized(img *quantizedImage, x int, y int) {
 	// Determine all sections which need to be updated
 	// TODO: improve on naive search
+	canvas := m.canvas()
 	intersectingSections := make([]*Section, 0, 4)
-	imgBounds := img.Bounds()
-	for _, section := range m.sections {
+	for _, section := range canvas.sections {
 		secW := section.meta.BotRight.X - section.meta.TopLeft.X
 		secH := section.meta.BotRight.Y - section.meta.TopLeft.Y
 		if x <= section.meta.TopLeft.X+secW &&
-			x+imgBounds.Dx() >= section.meta.TopLeft.X &&
+			x+img.width >= section.meta.TopLeft.X &&
 			y <= section.meta.TopLeft.Y+secH &&
-			y+imgBounds.Dy() >= section.meta.TopLeft.Y {
+			y+img.height >= section.meta.TopLeft.Y {
 			intersectingSections = append(intersectingSections, section)
 		}
 	}
 
 	for _, section := range intersectingSections {
-		log.Printf("%s: %d, %d", section.meta.Id, section.meta.TopLeft.X, section.meta.TopLeft.Y)
+		slog.Debug("putting image into section", "secId", section.meta.Id, "x", section.meta.TopLeft.X, "y", section.meta.TopLeft.Y)
 		// Calculate intersecting rectangle
 		topLeftX := max(section.meta.TopLeft.X, x)
 		topLeftY := max(section.meta.TopLeft.Y, y)
-		botRightX := min(section.meta.BotRight.X, x+imgBounds.Dx())
-		botRightY := min(section.meta.BotRight.Y, y+imgBounds.Dy())
+		botRightX := min(section.meta.BotRight.X, x+img.width)
+		botRightY := min(section.meta.BotRight.Y, y+img.height)
 
 		// Get the correct pixels in the section
 		m.SetPixelsInSection(section.meta,
@@ -275,15 +251,43 @@ func (m *Manager) PutImage(img image.Image, x int, y int) {
 			botRightX-topLeftX, botRightY-topLeftY, // Width of area to draw
 			img, topLeftX-x, topLeftY-y) // Translate into coords relative to top left of image
 
-		log.Printf("(%d, %d), (%d, %d) in (%d, %d)", topLeftX, topLeftY, botRightX, botRightY, topLeftX-x, topLeftY-y)
+		slog.Debug("put image into section", "secId", section.meta.Id, "topLeft", Point{topLeftX, topLeftY}, "botRight", Point{botRightX, botRightY}, "imgOffset", Point{topLeftX - x, topLeftY - y})
 	}
 
 }
 
-func (m *Manager) SetPixel(setPixData SetPixelData) {
-	t := fmt.Sprintf("u%d", m.colorProvider.bitsPerColor)
-	offset := fmt.Sprintf("#%d", setPixData.PixIdx)
-	m.redis.BitField(*m.ctx, setPixData.SecId, "set", t, offset, setPixData.ColorId)
+func (m *Manager) SetPixel(setPixData SetPixelData) error {
+	// The palette mustn't change between reading its bits and writing them
+	m.paintMu.RLock()
+	defer m.paintMu.RUnlock()
+	return m.store.SetPixel(*m.ctx, m.canvas().colorProvider.bitsPerColor, setPixData)
+}
+
+// Checks that the pixel is within its section and its color in the palette
+func (c *Canvas) validatePixel(setPixData SetPixelData) error {
+	section, ok := c.section(setPixData.SecId)
+	if !ok {
+		return ErrUnknownSection
+	}
+	if setPixData.PixIdx < 0 || setPixData.PixIdx >= section.Width()*section.Height() {
+		return fmt.Errorf("%w: pixel %d in section %s", ErrInvalidPixel, setPixData.PixIdx, setPixData.SecId)
+	}
+	if _, ok := c.colorProvider.colors[setPixData.ColorId]; !ok {
+		return fmt.Errorf("%w: color %d", ErrInvalidPixel, setPixData.ColorId)
+	}
+	return nil
+}
+
+// Sends the pixel to the subscribers of its section (on every replica) and
+// stores it. Invalid pixels are neither sent nor stored.
+func (m *Manager) placePixel(setPixData SetPixelData) error {
+	if err := m.canvas().validatePixel(setPixData); err != nil {
+		return err
+	}
+	if err := m.store.PublishPixel(*m.ctx, setPixData); err != nil {
+		return err
+	}
+	return m.SetPixel(setPixData)
 }
 
 func (setPixData SetPixelData) MarshalBinary() ([]byte, error) {
@@ -294,158 +298,422 @@ func (m *Manager) setupEventHandlers() {
 	m.eventHandlers[EventSetPixel] = func(e SocketEvent, c *Client) error {
 		var setPixData SetPixelData
 		if err := json.Unmarshal(e.Data, &setPixData); err != nil {
-			log.Println("error unmarshalling message:", err)
+			c.logger.Warn("error unmarshalling message", "type", e.Type, "err", err)
 			return err
 		}
-
-		err := m.redis.Publish(*m.ctx, "set_pixel", setPixData).Err()
-		if err != nil {
-			log.Println("could not publish set_pixel to redis:", err)
+		if err := m.canvas().validatePixel(setPixData); err != nil {
+			c.logger.Debug("rejected invalid pixel", "pixel", setPixData, "err", err)
+			return err
+		}
+		if err := m.authorizePixel(c, setPixData); err != nil {
+			c.logger.Debug("rejected pixel", "pixel", setPixData, "err", err)
 			return err
 		}
-		// Set pixel in redis
-		m.SetPixel(setPixData)
 
+		if err := m.placePixel(setPixData); err != nil {
+			c.logger.Error("could not place pixel", "err", err)
+			return err
+		}
 		return nil
 	}
 	m.eventHandlers[EventSubscribe] = func(e SocketEvent, c *Client) error {
 		var subIds SubscribeData
 		if err := json.Unmarshal(e.Data, &subIds); err != nil {
-			log.Println("error unmarshalling message:", err)
+			c.logger.Warn("error unmarshalling message", "type", e.Type, "err", err)
 			return err
 		}
+		if !c.can(PermRead) {
+			return ErrForbidden
+		}
 
+		newIds := make([]string, 0, len(subIds))
+		unknownIds := make([]string, 0)
 		m.Lock()
+		if _, ok := m.clients[c]; !ok {
+			// Disconnected while the request was queued
+			m.Unlock()
+			return nil
+		}
 		for _, id := range subIds {
-			m.sectionSubs[id][c] = struct{}{}
+			subs, ok := m.sectionSubs[id]
+			if !ok {
+				unknownIds = append(unknownIds, id)
+				continue
+			}
+			if _, ok := c.subscribedSections[id]; !ok {
+				newIds = append(newIds, id)
+			}
+			subs[c] = struct{}{}
 			c.subscribedSections[id] = struct{}{}
+			metrics.sectionSubscriptions.WithLabelValues(id).Set(float64(len(subs)))
 		}
 		m.Unlock()
+		m.retainSections(newIds...)
 
+		if len(unknownIds) > 0 {
+			c.logger.Warn("ignoring subscription to unknown sections", "secIds", unknownIds)
+			return ErrUnknownSection
+		}
 		return nil
 	}
 	m.eventHandlers[EventUnsubscribe] = func(e SocketEvent, c *Client) error {
 		var unsubIds UnsubscribeData
 		if err := json.Unmarshal(e.Data, &unsubIds); err != nil {
-			log.Println("error unmarshalling message:", err)
+			c.logger.Warn("error unmarshalling message", "type", e.Type, "err", err)
 			return err
 		}
 
+		removedIds := make([]string, 0, len(unsubIds))
 		m.Lock()
 		for _, id := range unsubIds {
+			if _, ok := c.subscribedSections[id]; !ok {
+				continue
+			}
+			removedIds = append(removedIds, id)
 			delete(m.sectionSubs[id], c)
 			delete(c.subscribedSections, id)
+			metrics.sectionSubscriptions.WithLabelValues(id).Set(float64(len(m.sectionSubs[id])))
 		}
 		m.Unlock()
+		m.releaseSections(removedIds...)
 
 		return nil
 	}
 }
 
+// Checks the permissions, area and rate limit of the credentials the client connected with
+func (m *Manager) authorizePixel(c *Client, setPixData SetPixelData) error {
+	if !c.can(PermPlace) {
+		return ErrForbidden
+	}
+	key := c.apiKey
+	if key == nil {
+		return nil
+	}
+	if key.Area != nil {
+		section, ok := m.canvas().section(setPixData.SecId)
+		if !ok {
+			return ErrUnknownSection
+		}
+		x := section.meta.TopLeft.X + setPixData.PixIdx%section.Width()
+		y := section.meta.TopLeft.Y + setPixData.PixIdx/section.Width()
+		if !key.Area.contains(x, y) {
+			return ErrOutsideArea
+		}
+	}
+	if ok, _ := m.takeAPIKeyLimit(key, 1); !ok {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// Closes the connections made with a revoked API key. Those to other replicas
+// stay open until they reconnect.
+func (m *Manager) disconnectAPIKey(id string) {
+	m.RLock()
+	defer m.RUnlock()
+	for client := range m.clients {
+		if client.apiKey != nil && client.apiKey.Id == id {
+			client.logger.Info("closing connection of revoked api key")
+			client.connection.Close()
+		}
+	}
+}
+
+// Connections without credentials stay anonymous. With an access token or API
+// key (in the headers or the query) they act on its behalf.
 func (manager *Manager) ServeWS(w http.ResponseWriter, r *http.Request) {
-	log.Println("New client")
+	claims, key, err := manager.authenticateRequest(r, true)
+	switch {
+	case errors.Is(err, ErrInvalidToken):
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	case err != nil && !errors.Is(err, ErrMissingCredentials):
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	case key != nil && !key.Can(PermRead) && !key.Can(PermPlace):
+		countError("ServeWS", "forbidden")
+		http.Error(w, "Permission denied", http.StatusForbidden)
+		return
+	}
+
 	// Upgrade http request
 	conn, err := websocketUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("Could not upgrade request:", err)
+		loggerFrom(r.Context()).Warn("could not upgrade request", "err", err)
+		countError("ServeWS", "upgrade")
 		return
 	}
 
 	// Create new client
 	client := NewClient(conn, manager)
-	manager.addClient(client)
+	if key != nil {
+		client.apiKey = key
+		client.logger = client.logger.With("apiKey", key)
+	} else if claims != nil {
+		client.claims = claims
+		client.logger = client.logger.With("username", claims.Username)
+	}
+	token := r.URL.Query().Get("session")
+	manager.sessions.AwaitFlushed(token, manager.config.Websocket.WriteWait)
+	if err := manager.addClient(client, token); err != nil {
+		if errors.Is(err, ErrShuttingDown) {
+			closeWithReconnect(conn, manager.config.Websocket.WriteWait)
+		} else {
+			client.logger.Error("could not attach session", "err", err)
+			countError("ServeWS", "session")
+		}
+		conn.Close()
+		return
+	}
+	client.logger.Info("new client")
 
-	go client.ReadUserMsgs()
+	go func() {
+		defer manager.readers.Done()
+		client.ReadUserMsgs()
+	}()
 	go client.WriteMsgs()
 }
 
-func (m *Manager) addClient(client *Client) {
+// Registers the client and resumes the session belonging to the token (restoring
+// the client's subscriptions and queueing the events it missed) or starts a new
+// one. Pixels are fanned out and buffered for sessions under the same lock, so
+// each reaches either the session or the client.
+func (m *Manager) addClient(client *Client, token string) error {
 	m.Lock()
 	defer m.Unlock()
 
+	if m.shuttingDown {
+		return ErrShuttingDown
+	}
+	session, resumed := m.sessions.Resume(token)
+	sessionData := SessionData{newSessionToken(), false, 0}
+	if resumed {
+		sessionData = SessionData{session.token, true, len(session.missed)}
+	}
+	data, err := json.Marshal(sessionData)
+	var evtBytes []byte
+	if err == nil {
+		evtBytes, err = json.Marshal(SocketEvent{EventSession, data})
+	}
+	if err != nil {
+		if resumed {
+			m.sessions.Restore(session)
+		}
+		return err
+	}
+	client.sessionToken = sessionData.Token
+	client.pending = append(client.pending, evtBytes)
+	if resumed {
+		client.subscribedSections = session.sections
+		client.pending = append(client.pending, session.missed...)
+		metrics.sessionsResumed.Inc()
+		client.logger.Info("resumed session", "sections", len(session.sections), "missed", len(session.missed))
+	}
+
+	m.readers.Add(1)
 	m.clients[client] = true
-	log.Println("Nr clients:", len(m.clients))
+	// Subscriptions restored from a session (whose channels are still retained)
+	for secId := range client.subscribedSections {
+		if _, ok := m.sectionSubs[secId]; !ok {
+			delete(client.subscribedSections, secId)
+			go m.releaseSections(secId)
+			continue
+		}
+		m.sectionSubs[secId][client] = struct{}{}
+		metrics.sectionSubscriptions.WithLabelValues(secId).Set(float64(len(m.sectionSubs[secId])))
+	}
+	metrics.connectedClients.Set(float64(len(m.clients)))
+	slog.Debug("client added", "clients", len(m.clients))
+	return nil
 }
 
 func (m *Manager) removeClient(client *Client) {
+	m.detachClient(client, nil, nil)
+}
+
+// Removes the client and keeps its subscriptions as a session, which buffers
+// the events the client never got: those its writer took but couldn't write,
+// those still queued and those which didn't fit into the queue anymore.
+// Clients which were already removed hand unwritten events to their session.
+func (m *Manager) detachClient(client *Client, unwritten, overflow [][]byte) {
 	m.Lock()
 	defer m.Unlock()
 
-	log.Println("Removing client!")
-
-	if _, ok := m.clients[client]; ok {
-		client.connection.Close()
-		close(client.setPixEvtJson)
-		delete(m.clients, client)
-		for secId := range client.subscribedSections {
-			delete(m.sectionSubs[secId], client)
+	if _, ok := m.clients[client]; !ok {
+		if len(unwritten) > 0 {
+			m.sessions.Prepend(client.sessionToken, unwritten)
 		}
+		return
 	}
-	log.Println("Nr clients:", len(m.clients))
+	client.logger.Info("removing client")
+	delete(m.clients, client)
+	for secId := range client.subscribedSections {
+		delete(m.sectionSubs[secId], client)
+		metrics.sectionSubscriptions.WithLabelValues(secId).Set(float64(len(m.sectionSubs[secId])))
+	}
+	// Nothing gets queued for the client anymore
+	missed := slices.Clone(unwritten)
+drain:
+	for {
+		select {
+		case evt := <-client.setPixEvtJson:
+			missed = append(missed, evt)
+		default:
+			break drain
+		}
+	}
+	missed = append(missed, overflow...)
+	client.connection.Close()
+	close(client.setPixEvtJson)
+	// The session takes over the client's references to the section channels
+	m.sessions.Detach(client.sessionToken, client.subscribedSections, missed, client.writerDone)
+
+	metrics.connectedClients.Set(float64(len(m.clients)))
+	slog.Debug("client removed", "clients", len(m.clients))
 }
 
 func (m *Manager) routeEvent(event SocketEvent, c *Client) error {
 	if handler, ok := m.eventHandlers[event.Type]; ok {
+		metrics.eventsProcessed.WithLabelValues(event.Type, "client").Inc()
 		if err := handler(event, c); err != nil {
+			countError("event_"+event.Type, "handler")
 			return err
 		}
 		return nil
 	} else {
+		countError("routeEvent", "unknown_event")
 		return ErrUnknownEvent
 	}
 }
 
-// Establishes the connection to redis and sets up the event processing loop
+func (m *Manager) processClientRequest(req ClientRequest) {
+	if err := m.routeEvent(*req.request, req.c); err != nil {
+		req.logger.Warn("could not process client request", "type", req.request.Type, "err", err)
+		return
+	}
+	req.logger.Debug("processed client request", "type", req.request.Type)
+}
+
+func (m *Manager) startEventLoop() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.shuttingDown || m.eventsRunning {
+		return
+	}
+	m.eventsRunning = true
+	go m.ListenForEvents()
+}
+
+// Fans out the pixels published by all replicas. Returns once Shutdown stops the loop.
 func (m *Manager) ListenForEvents() {
-	pubsubCh := m.pubsub.Channel()
+	defer close(m.eventsStopped)
+	pixels := m.store.Pixels()
 	for {
 		select {
-		case clientRequest := <-m.clientRequests:
-			go m.routeEvent(*clientRequest.request, clientRequest.c)
-			log.Println("Processed client request", clientRequest.request.Type)
-		case msg := <-pubsubCh:
-			log.Println("Read evt from pubsub-queue:", msg.Payload)
-			if msg.Channel == "set_pixel" {
-				var setPixData SetPixelData
-				b := []byte(msg.Payload)
-				if err := json.Unmarshal(b, &setPixData); err != nil {
-					log.Println("could not unmarshal payload of pubsub evt", err)
-					continue
-				}
-
-				evt := SocketEvent{"set_pixel", b}
-				evtBytes, err := json.Marshal(evt)
-				if err != nil {
-					log.Println("could not marshal socket event:", err)
-				}
-				for client := range m.sectionSubs[setPixData.SecId] {
-					client.setPixEvtJson <- evtBytes
-				}
-			} else {
-				log.Println("unknown channel", msg.Channel)
-			}
-			//case <-time.After(60 * time.Second):
-			//	log.Println("Waiting...")
+		case <-m.stopEvents:
+			return
+		case setPixData := <-pixels:
+			metrics.fanoutQueueDepth.Set(float64(len(pixels)))
+			m.fanOutPixel(setPixData)
 		}
 	}
 }
 
+func (m *Manager) fanOutPixel(setPixData SetPixelData) {
+	metrics.eventsProcessed.WithLabelValues(EventSetPixel, "pubsub").Inc()
+	b, err := json.Marshal(setPixData)
+	if err != nil {
+		slog.Error("could not marshal pixel", "err", err)
+		countError("ListenForEvents", "marshal")
+		return
+	}
+
+	evt := SocketEvent{"set_pixel", b}
+	evtBytes, err := json.Marshal(evt)
+	if err != nil {
+		slog.Error("could not marshal socket event", "err", err)
+		countError("ListenForEvents", "marshal")
+		return
+	}
+	// Clients which can't keep up are disconnected rather than stalling everybody
+	// else. Their session gets the events they didn't receive, so they can resume
+	// it and catch up.
+	var slow []*Client
+	m.RLock()
+	for client := range m.sectionSubs[setPixData.SecId] {
+		select {
+		case client.setPixEvtJson <- evtBytes:
+		default:
+			slow = append(slow, client)
+		}
+	}
+	m.sessions.Buffer(setPixData.SecId, evtBytes)
+	m.RUnlock()
+	for _, client := range slow {
+		client.logger.Warn("client is too slow, disconnecting")
+		countError("fanout", "slow_client")
+		m.detachClient(client, nil, [][]byte{evtBytes})
+	}
+}
+
+// Subscribes to the sections which didn't have any local subscribers before.
+// Each call has to be matched by a call to releaseSections.
+func (m *Manager) retainSections(secIds ...string) {
+	m.channelsMu.Lock()
+	defer m.channelsMu.Unlock()
+
+	for _, secId := range secIds {
+		m.channelRefs[secId]++
+		if m.channelRefs[secId] > 1 {
+			continue
+		}
+		if err := m.store.SubscribeSection(*m.ctx, secId); err != nil {
+			// The subscription will be retried once the store is reachable again
+			slog.Warn("could not subscribe to section", "secId", secId, "err", err)
+		}
+	}
+	metrics.pubsubChannels.Set(float64(len(m.channelRefs)))
+}
+
+// Unsubscribes from the sections which no longer have local subscribers
+func (m *Manager) releaseSections(secIds ...string) {
+	m.channelsMu.Lock()
+	defer m.channelsMu.Unlock()
+
+	for _, secId := range secIds {
+		if m.channelRefs[secId] == 0 {
+			continue
+		}
+		m.channelRefs[secId]--
+		if m.channelRefs[secId] > 0 {
+			continue
+		}
+		delete(m.channelRefs, secId)
+		if err := m.store.UnsubscribeSection(*m.ctx, secId); err != nil {
+			slog.Warn("could not unsubscribe from section", "secId", secId, "err", err)
+		}
+	}
+	metrics.pubsubChannels.Set(float64(len(m.channelRefs)))
+}
+
 type SectionsMeta = struct {
 	Sections     []SectionMetaData `json:"sections"`
 	BitsPerPixel int               `json:"bitsPerPixel"`
 	Position     Point             `json:"position"`
 }
 
-func (m *Manager) getSectionsMetaData() []SectionMetaData {
-	sectionsMeta := make([]SectionMetaData, len(m.sections))
-	for id, section := range m.sections {
+func (c *Canvas) sectionsMetaData() []SectionMetaData {
+	sectionsMeta := make([]SectionMetaData, len(c.sections))
+	for id, section := range c.sections {
 		sectionsMeta[id] = section.meta
 	}
 	return sectionsMeta
 }
 
-func (m *Manager) getPosition(posId string) Point {
-	pos, posExists := m.positions[posId]
+func (c *Canvas) position(posId string) Point {
+	pos, posExists := c.positions[posId]
 
 	if !posExists {
 		return *NewPoint(0, 0)
@@ -456,15 +724,15 @@ func (m *Manager) getPosition(posId string) Point {
 func (m *Manager) ServeSectionsMeta(w http.ResponseWriter, r *http.Request) {
 	posId := r.URL.Query().Get("pos")
 	if posId != "" {
-		log.Println("Querying for posId:", posId)
+		loggerFrom(r.Context()).Debug("querying for posId", "posId", posId)
 	}
-	pos := m.getPosition(posId)
-
-	sectionsMeta := SectionsMeta{m.getSectionsMetaData(), m.colorProvider.bitsPerColor, pos}
+	canvas := m.canvas()
+	sectionsMeta := SectionsMeta{canvas.sectionsMetaData(), canvas.colorProvider.bitsPerColor, canvas.position(posId)}
 
 	sectionsMetaJson, err := json.Marshal(sectionsMeta)
 	if err != nil {
-		log.Println("Could not marshal sections metadata:", err)
+		loggerFrom(r.Context()).Error("could not marshal sections metadata", "err", err)
+		countError("ServeSectionsMeta", "marshal")
 		w.WriteHeader(500)
 		return
 	}
@@ -480,16 +748,10 @@ type ColorChoice = struct {
 }
 
 func (m *Manager) ServeColors(w http.ResponseWriter, r *http.Request) {
-	colorChoices := make([]ColorChoice, len(m.colorProvider.colors))
-
-	idx := 0
-	for id, color := range m.colorProvider.colors {
-		colorChoices[idx] = ColorChoice{id, m.colorProvider.order[id], []int{int(color.R), int(color.G), int(color.B)}}
-		idx++
-	}
-	colorsJson, err := json.Marshal(colorChoices)
+	colorsJson, err := json.Marshal(m.canvas().colorProvider.choices())
 	if err != nil {
-		log.Println("could not marshal colors")
+		loggerFrom(r.Context()).Error("could not marshal colors", "err", err)
+		countError("ServeColors", "marshal")
 		w.WriteHeader(500)
 		return
 	}
@@ -498,16 +760,19 @@ func (m *Manager) ServeColors(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Manager) getCompressSectionData(secId string) ([]byte, error) {
-	data, err := m.redis.Get(*m.ctx, REDIS_KEYS.SEC_PIX_DATA(secId)).Bytes()
+	data, err := m.store.SectionData(*m.ctx, secId)
 	if err != nil {
-		log.Printf("could not load section data for section %s from redis: %v\n", secId, err)
+		slog.Error("could not load section data", "secId", secId, "err", err)
 		return nil, err
 	}
 	compressed, err := Compress(data)
 	if err != nil {
-		log.Printf("could not compress section data for section %s from redis: %v\n", secId, err)
+		slog.Error("could not compress section data", "secId", secId, "err", err)
 		return nil, err
 	}
+	if len(compressed) > 0 {
+		metrics.sectionDataCompression.Observe(float64(len(data)) / float64(len(compressed)))
+	}
 
 	return compressed, nil
 }
@@ -516,33 +781,25 @@ func (m *Manager) ServeSectionData(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	// log served section, count how often sections have been served
-	log.Println("S", vars["secId"])
-	m.redis.HIncrBy(*m.ctx, "section_counts", vars["secId"], 1)
+	loggerFrom(r.Context()).Debug("serving section data", "secId", vars["secId"])
+	if err := m.store.CountSectionServed(*m.ctx, vars["secId"]); err != nil {
+		loggerFrom(r.Context()).Warn("could not count served section", "secId", vars["secId"], "err", err)
+	}
 
 	data, err := m.getCompressSectionData(vars["secId"])
 	if err != nil {
+		countError("ServeSectionData", "load")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Write(data)
+	n, _ := w.Write(data)
+	metrics.sectionDataBytesServed.Add(float64(n))
 }
 
-// TODO: worry about hashing and stuff
 func (m *Manager) LoadUser(username string) (User, error) {
-	var user User
-	key := fmt.Sprintf("user:%s", username)
-	if res, err := m.redis.Exists(*m.ctx, key).Result(); err != nil || res == 0 {
-		return User{}, fmt.Errorf("User does not exist: %s", username)
-	}
-	cmdReturn := m.redis.HGetAll(*m.ctx, key)
-
-	if err := cmdReturn.Scan(&user); err != nil {
-		return User{}, err
-	}
-
-	return user, nil
+	return m.store.User(*m.ctx, username)
 }
 
 func (m *Manager) AdjustDataToColorBits(data []byte, nrBits, curBitsPerColor, newBitsPerColor int) []byte {
@@ -571,38 +828,44 @@ func (m *Manager) AdjustDataToColorBits(data []byte, nrBits, curBitsPerColor, ne
 }
 
 func (m *Manager) UpdateColors(colorUpdate ColorUpdate) error {
-	log.Printf("updating colors: %+v", colorUpdate)
+	slog.Info("updating colors", "colors", len(colorUpdate.Colors), "bitsPerColor", colorUpdate.BitsPerColor, "defaultColor", colorUpdate.DefaultColor)
 	// Update bits per pixel
 	newColors := colorUpdate.Colors
 	newBitsPerColor := colorUpdate.BitsPerColor
 
-	curBitsPerColor, err := m.redis.Get(*m.ctx, REDIS_KEYS.BITS_PER_COLOR).Int()
+	// No pixels may be written while the sections are re-encoded
+	m.paintMu.Lock()
+	defer m.paintMu.Unlock()
+
+	curBitsPerColor, _, err := m.store.Palette(*m.ctx)
 	if err != nil {
-		log.Println("error when getting key ", err)
 		return err
 	}
-	m.redis.Set(*m.ctx, REDIS_KEYS.BITS_PER_COLOR, newBitsPerColor, 0)
 
 	// Update colors
 	colors := make([]*Color, len(newColors))
 	for i := range len(newColors) {
 		colors[i] = &newColors[i]
 	}
-	m.colorProvider = NewColorProvider(newBitsPerColor, colors...)
-	m.colorProvider.SetDefaultColor(colorUpdate.DefaultColor)
-	m.SaveColorProvider()
+	colorProvider := NewColorProvider(newBitsPerColor, colors...)
+	colorProvider.SetDefaultColor(colorUpdate.DefaultColor)
+	if err := m.saveColorProvider(colorProvider); err != nil {
+		return err
+	}
+	m.updateCanvas(func(c *Canvas) { c.colorProvider = colorProvider })
 
 	// Update bits of sections
-	for _, section := range m.sections {
+	for _, section := range m.canvas().sections {
 		// Update data
-		data, err := m.redis.Get(*m.ctx, REDIS_KEYS.SEC_PIX_DATA(section.meta.Id)).Bytes()
+		data, err := m.store.SectionData(*m.ctx, section.meta.Id)
 		if err != nil {
 			return err
 		}
 		nrBits := section.Width() * section.Height() * curBitsPerColor
 		newData := m.AdjustDataToColorBits(data, nrBits, curBitsPerColor, newBitsPerColor)
-		m.redis.Del(*m.ctx, REDIS_KEYS.SEC_PIX_DATA(section.meta.Id))
-		m.redis.Set(*m.ctx, REDIS_KEYS.SEC_PIX_DATA(section.meta.Id), newData, 0)
+		if err := m.store.SaveSectionData(*m.ctx, section.meta.Id, newData); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -610,14 +873,12 @@ func (m *Manager) UpdateColors(colorUpdate ColorUpdate) error {
 // TODO: worry about performance (set row-wise / pipe requests?)
 func (m *Manager) setPixelsInSectionTest(secMeta SectionMetaData, secX, secY, w, h int) error {
 	// set row by row
-	log.Printf("setting at section (%d,%d) for w,h %d,%d", secX, secY, w, h)
+	slog.Debug("setting test pixels", "secX", secX, "secY", secY, "w", w, "h", h)
 	secWidth := secMeta.BotRight.X - secMeta.TopLeft.X
-	log.Printf("sec width %d", secWidth)
+	slog.Debug("section width", "width", secWidth)
 	for row := range h {
 		// Slice into image
 		for col := range w {
-			log.Println(row, col)
-			log.Println((secY+row)*secWidth + secX + col)
 			m.SetPixel(SetPixelData{SecId: secMeta.Id, PixIdx: (secY+row)*secWidth + (secX + col), ColorId: 5})
 		}
 		//rowY := row + secY
@@ -627,7 +888,7 @@ func (m *Manager) setPixelsInSectionTest(secMeta SectionMetaData, secX, secY, w,
 }
 
 func (m *Manager) Test(w http.ResponseWriter, r *http.Request) {
-	section := m.sections[12]
-	log.Println(section.meta)
+	section := m.canvas().sections[12]
+	slog.Debug("test section", "meta", section.meta)
 	m.setPixelsInSectionTest(section.meta, 0, 0, 10, 10)
 }
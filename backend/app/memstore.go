@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+var _ CanvasStore = (*MemoryStore)(nil)
+
+// Keeps the whole canvas in the memory of this process. Meant for development and
+// tests: nothing survives a restart and pixels are only shared with the clients
+// connected to this replica.
+type MemoryStore struct {
+	sync.Mutex
+	sections     []SectionMetaData
+	data         map[string][]byte
+	served       map[string]int
+	bitsPerColor int
+	colors       []ColorChoice
+	positions    map[string]PositionInfo
+	users        map[string]User
+	tokens       tokenLists
+	localPubsub
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{localPubsub: newLocalPubsub(), tokens: newTokenLists()}
+	s.reset()
+	return s
+}
+
+func (s *MemoryStore) reset() {
+	s.sections = nil
+	s.data = make(map[string][]byte)
+	s.served = make(map[string]int)
+	s.bitsPerColor = 0
+	s.colors = nil
+	s.positions = make(map[string]PositionInfo)
+	if s.users == nil {
+		s.users = make(map[string]User)
+	}
+}
+
+func (s *MemoryStore) Empty() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.sections) == 0 && s.bitsPerColor == 0
+}
+
+func (s *MemoryStore) Open(ctx context.Context) error { return nil }
+func (s *MemoryStore) Ping(ctx context.Context) error { return nil }
+func (s *MemoryStore) Close() error                   { return nil }
+
+func (s *MemoryStore) Reset(ctx context.Context) error {
+	s.Lock()
+	defer s.Unlock()
+	s.reset()
+	return nil
+}
+
+func (s *MemoryStore) SectionsMeta(ctx context.Context) ([]SectionMetaData, error) {
+	s.Lock()
+	defer s.Unlock()
+	return slices.Clone(s.sections), nil
+}
+
+func (s *MemoryStore) SaveSectionsMeta(ctx context.Context, sections []SectionMetaData) error {
+	s.Lock()
+	defer s.Unlock()
+	s.sections = slices.Clone(sections)
+	return nil
+}
+
+func (s *MemoryStore) SectionData(ctx context.Context, secId string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.data[secId]
+	if !ok {
+		return nil, fmt.Errorf("no data for section %s", secId)
+	}
+	return slices.Clone(data), nil
+}
+
+func (s *MemoryStore) SaveSectionData(ctx context.Context, secId string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.data[secId] = slices.Clone(data)
+	return nil
+}
+
+func (s *MemoryStore) SetPixel(ctx context.Context, bitsPerColor int, setPixData SetPixelData) error {
+	s.Lock()
+	defer s.Unlock()
+	data, ok := s.data[setPixData.SecId]
+	if !ok {
+		return fmt.Errorf("no data for section %s", setPixData.SecId)
+	}
+	if setPixData.PixIdx < 0 || (setPixData.PixIdx+1)*bitsPerColor > len(data)*8 {
+		return fmt.Errorf("pixel %d out of range for section %s", setPixData.PixIdx, setPixData.SecId)
+	}
+	setBits(data, setPixData.PixIdx*bitsPerColor, bitsPerColor, setPixData.ColorId)
+	return nil
+}
+
+// Reads `bits` bits at the bit offset, most significant bit first. Missing data reads as 0.
+func getBits(data []byte, offset, bits int) int {
+	value := 0
+	for i := range bits {
+		pos := offset + i
+		value <<= 1
+		if pos/8 < len(data) && data[pos/8]&(byte(1)<<(7-pos%8)) != 0 {
+			value |= 1
+		}
+	}
+	return value
+}
+
+// Writes the lowest `bits` bits of value at the bit offset, most significant bit
+// first. Grows the data like redis' BITFIELD does.
+func setBits(data []byte, offset, bits, value int) []byte {
+	if need := (offset + bits + 7) / 8; need > len(data) {
+		data = append(data, make([]byte, need-len(data))...)
+	}
+	for i := range bits {
+		pos := offset + i
+		mask := byte(1) << (7 - pos%8)
+		if (value>>(bits-1-i))&1 == 1 {
+			data[pos/8] |= mask
+		} else {
+			data[pos/8] &^= mask
+		}
+	}
+	return data
+}
+
+func (s *MemoryStore) CountSectionServed(ctx context.Context, secId string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.served[secId]++
+	return nil
+}
+
+func (s *MemoryStore) Palette(ctx context.Context) (int, []ColorChoice, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.bitsPerColor == 0 {
+		return 0, nil, fmt.Errorf("no palette stored")
+	}
+	return s.bitsPerColor, slices.Clone(s.colors), nil
+}
+
+func (s *MemoryStore) SavePalette(ctx context.Context, bitsPerColor int, colors []ColorChoice) error {
+	s.Lock()
+	defer s.Unlock()
+	s.bitsPerColor = bitsPerColor
+	s.colors = slices.Clone(colors)
+	return nil
+}
+
+func (s *MemoryStore) Positions(ctx context.Context) (map[string]PositionInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+	return maps.Clone(s.positions), nil
+}
+
+func (s *MemoryStore) SavePosition(ctx context.Context, posId string, pos PositionInfo) error {
+	s.Lock()
+	defer s.Unlock()
+	s.positions[posId] = pos
+	return nil
+}
+
+func (s *MemoryStore) DeletePosition(ctx context.Context, posId string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.positions, posId)
+	return nil
+}
+
+func (s *MemoryStore) User(ctx context.Context, username string) (User, error) {
+	s.Lock()
+	defer s.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return User{}, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return user, nil
+}
+
+func (s *MemoryStore) SaveUser(ctx context.Context, user User) error {
+	s.Lock()
+	defer s.Unlock()
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, user User) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.users[user.Username]; ok {
+		return fmt.Errorf("%w: %s", ErrUserExists, user.Username)
+	}
+	s.users[user.Username] = user
+	return nil
+}
+
+func (s *MemoryStore) SaveRefreshToken(ctx context.Context, id string, token RefreshToken) error {
+	s.Lock()
+	defer s.Unlock()
+	s.tokens.saveRefresh(id, token)
+	return nil
+}
+
+func (s *MemoryStore) TakeRefreshToken(ctx context.Context, id string) (RefreshToken, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.tokens.takeRefresh(id)
+}
+
+func (s *MemoryStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	s.tokens.revoke(jti, expiresAt)
+	return nil
+}
+
+func (s *MemoryStore) TokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.tokens.revoked(jti), nil
+}
+
+func (s *MemoryStore) SaveAPIKey(ctx context.Context, key APIKey) error {
+	s.Lock()
+	defer s.Unlock()
+	s.tokens.APIKeys[key.Id] = key
+	return nil
+}
+
+func (s *MemoryStore) APIKey(ctx context.Context, id string) (APIKey, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.tokens.apiKey(id)
+}
+
+func (s *MemoryStore) APIKeys(ctx context.Context) ([]APIKey, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.tokens.apiKeyList(), nil
+}
+
+func (s *MemoryStore) DeleteAPIKey(ctx context.Context, id string) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.tokens.deleteAPIKey(id)
+}
+
+func (s *MemoryStore) EnsureSubscribed(ctx context.Context) bool { return true }
+func (s *MemoryStore) Subscribed() bool                          { return true }
+
+// Pubsub within a single process: published pixels are handed straight back if
+// their section is subscribed
+type localPubsub struct {
+	mu         sync.Mutex
+	subscribed map[string]struct{}
+	pixels     chan SetPixelData
+}
+
+func newLocalPubsub() localPubsub {
+	return localPubsub{
+		subscribed: make(map[string]struct{}),
+		pixels:     make(chan SetPixelData, 1024),
+	}
+}
+
+// Pixels are dropped when nobody keeps up with reading them, like a slow redis
+// pubsub client would
+func (p *localPubsub) PublishPixel(ctx context.Context, setPixData SetPixelData) error {
+	p.mu.Lock()
+	_, ok := p.subscribed[setPixData.SecId]
+	p.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	select {
+	case p.pixels <- setPixData:
+	default:
+		slog.Warn("dropping pixel, pubsub queue is full", "secId", setPixData.SecId)
+		countError("pubsub", "queue_full")
+	}
+	return nil
+}
+
+func (p *localPubsub) SubscribeSection(ctx context.Context, secId string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.subscribed[secId] = struct{}{}
+	return nil
+}
+
+func (p *localPubsub) UnsubscribeSection(ctx context.Context, secId string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.subscribed, secId)
+	return nil
+}
+
+func (p *localPubsub) Pixels() <-chan SetPixelData { return p.pixels }
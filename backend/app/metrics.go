@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+const metricsNamespace = "bipix"
+
+var metrics = struct {
+	connectedClients        prometheus.Gauge
+	sectionSubscriptions    *prometheus.GaugeVec
+	eventsProcessed         *prometheus.CounterVec
+	fanoutQueueDepth        prometheus.Gauge
+	clientRequestQueue      prometheus.Gauge
+	clientRequestsThrottled prometheus.Counter
+	redisCommandDuration    *prometheus.HistogramVec
+	sectionDataBytesServed  prometheus.Counter
+	sectionDataCompression  prometheus.Histogram
+	imageLoadDuration       prometheus.Histogram
+	handlerErrors           *prometheus.CounterVec
+	detachedSessions        prometheus.Gauge
+	sessionsResumed         prometheus.Counter
+	pubsubChannels          prometheus.Gauge
+}{
+	connectedClients: promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connected_clients",
+		Help:      "Number of currently connected websocket clients.",
+	}),
+	sectionSubscriptions: promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "section_subscriptions",
+		Help:      "Number of clients currently subscribed to a section.",
+	}, []string{"section"}),
+	eventsProcessed: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "events_processed_total",
+		Help:      "Number of processed events by type and source (client or pubsub).",
+	}, []string{"type", "source"}),
+	fanoutQueueDepth: promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "fanout_queue_depth",
+		Help:      "Number of pubsub messages waiting to be fanned out to clients.",
+	}),
+	clientRequestQueue: promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_request_queue_depth",
+		Help:      "Number of client requests waiting to be routed.",
+	}),
+	clientRequestsThrottled: promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_requests_throttled_total",
+		Help:      "Number of client requests which had to wait for a full worker queue.",
+	}),
+	redisCommandDuration: promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Latency of redis commands.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"}),
+	sectionDataBytesServed: promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "section_data_bytes_served_total",
+		Help:      "Number of (compressed) section data bytes written to http responses.",
+	}),
+	sectionDataCompression: promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "section_data_compression_ratio",
+		Help:      "Ratio of raw to compressed size of served section data.",
+		Buckets:   []float64{1, 1.5, 2, 4, 8, 16, 32, 64, 128, 256},
+	}),
+	imageLoadDuration: promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_load_duration_seconds",
+		Help:      "Time it takes to load an image onto the canvas.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}),
+	handlerErrors: promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "handler_errors_total",
+		Help:      "Number of errors by handler and reason.",
+	}, []string{"handler", "reason"}),
+	detachedSessions: promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "detached_sessions",
+		Help:      "Number of sessions of disconnected clients which can still be resumed.",
+	}),
+	sessionsResumed: promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sessions_resumed_total",
+		Help:      "Number of reconnecting clients which resumed their session.",
+	}),
+	pubsubChannels: promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pubsub_section_channels",
+		Help:      "Number of section channels this replica is subscribed to.",
+	}),
+}
+
+func countError(handler, reason string) {
+	metrics.handlerErrors.WithLabelValues(handler, reason).Inc()
+}
+
+// Records the latency of every command sent to redis
+type redisMetricsHook struct{}
+
+func (redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		metrics.redisCommandDuration.WithLabelValues(cmd.Name()).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		metrics.redisCommandDuration.WithLabelValues("pipeline").Observe(time.Since(start).Seconds())
+		return err
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+var (
+	ErrInvalidUsername = errors.New("usernames need 3 to 32 letters, digits, '-' or '_'")
+	ErrInvalidPassword = fmt.Errorf("passwords need %d to %d characters", minPasswordLen, maxPasswordLen)
+	errMalformedHash   = errors.New("malformed password hash")
+)
+
+const (
+	minPasswordLen = 10
+	maxPasswordLen = 128
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{3,32}$`)
+
+// Parameters of newly created hashes, the second recommendation of RFC 9106
+var argonParams = argonParameters{memory: 64 * 1024, time: 3, threads: 4, keyLen: 32}
+
+// Each hash takes argonParams.memory, so only this many are computed at once
+var hashSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+func argonKey(password Secret, salt []byte, p argonParameters) []byte {
+	hashSlots <- struct{}{}
+	defer func() { <-hashSlots }()
+	return argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLen)
+}
+
+type argonParameters struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+	keyLen  uint32
+}
+
+func validateCredentials(username string, password Secret) error {
+	if !usernamePattern.MatchString(username) {
+		return ErrInvalidUsername
+	}
+	if n := len([]rune(string(password))); n < minPasswordLen || n > maxPasswordLen {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// Returns an argon2id hash in the PHC string format, e.g.
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>
+func hashPassword(password Secret) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := argonParams
+	key := argonKey(password, salt, p)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Checks the password against a hash created by hashPassword. needsRehash is
+// set if the hash was created with other parameters than the current ones.
+func verifyPassword(hash string, password Secret) (ok, needsRehash bool, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, false, errMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, errMalformedHash
+	}
+	var p argonParameters
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return false, false, errMalformedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, errMalformedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, errMalformedHash
+	}
+	p.keyLen = uint32(len(key))
+
+	other := argonKey(password, salt, p)
+	ok = subtle.ConstantTimeCompare(key, other) == 1
+	return ok, p != argonParams, nil
+}
+
+// Checks the password of a user as loaded from the store. Accounts created
+// before passwords were hashed still carry their plaintext password, these
+// (and outdated hashes) are reported as needing a new hash.
+func (u User) checkPassword(password Secret) (ok, needsRehash bool, err error) {
+	if u.PasswordHash == "" {
+		if u.Password == "" {
+			return false, false, nil
+		}
+		ok = subtle.ConstantTimeCompare([]byte(u.Password), []byte(password)) == 1
+		return ok, true, nil
+	}
+	return verifyPassword(u.PasswordHash, password)
+}
+
+// Replaces whatever the user authenticated with by a hash of password
+func (u *User) setPassword(password Secret) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = hash
+	u.Password = ""
+	return nil
+}
+
+// Like setPassword, but also invalidates the refresh tokens issued so far
+func (u *User) changePassword(password Secret) error {
+	if err := u.setPassword(password); err != nil {
+		return err
+	}
+	u.TokenGeneration++
+	return nil
+}
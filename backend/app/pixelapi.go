@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// A pixel in global coordinates, as set via PUT /pixels
+type PixelPlacement struct {
+	X     int        `json:"x"`
+	Y     int        `json:"y"`
+	Color PixelColor `json:"color"`
+}
+
+// Either a color id or a hex color ("#rrggbb" or "#rgb") of the palette
+type PixelColor struct {
+	id  int
+	hex string
+}
+
+func (c *PixelColor) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.id); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &c.hex); err != nil || c.hex == "" {
+		return errors.New("colors are color ids or hex strings")
+	}
+	return nil
+}
+
+// Returns the id of the color in the palette
+func (c PixelColor) resolve(cp *ColorProvider) (int, error) {
+	if c.hex == "" {
+		if _, ok := cp.colors[c.id]; !ok {
+			return 0, fmt.Errorf("unknown color id %d", c.id)
+		}
+		return c.id, nil
+	}
+	rgb, err := ParseHexColorFast(c.hex)
+	if err != nil {
+		return 0, fmt.Errorf("invalid hex color %q", c.hex)
+	}
+	color, err := cp.FindColor(rgb)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not in the palette", c.hex)
+	}
+	return cp.ids[color], nil
+}
+
+func (c *Color) hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Takes n tokens from the rate limit of whoever made the authorized request:
+// the API key's own (which already paid for the request itself) or the one of users
+func (m *Manager) takeRequestLimit(r *http.Request, n int) (bool, time.Duration) {
+	if key, ok := apiKeyFrom(r.Context()); ok {
+		if n <= 1 {
+			return true, 0
+		}
+		return m.takeAPIKeyLimit(key, n-1)
+	}
+	claims, _ := claimsFrom(r.Context())
+	return m.rateLimits.take("user:"+claims.Username, float64(m.config.API.PixelsPerSecond), m.config.API.PixelBurst, n)
+}
+
+// Most pixels one request may set, batches beyond the burst could never pass the rate limit
+func (m *Manager) maxBatchSize(r *http.Request) int {
+	burst := m.config.API.PixelBurst
+	if key, ok := apiKeyFrom(r.Context()); ok {
+		burst = key.Burst
+	}
+	return min(m.config.API.MaxBatchSize, burst)
+}
+
+// Sets a batch of pixels. The whole batch is validated before anything is set, but
+// the pixels are placed one by one: if the store fails, the error response says
+// how many of them have been placed (in order).
+func PutPixelsHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	logger := loggerFrom(r.Context())
+
+	var placements []PixelPlacement
+	if err := json.NewDecoder(r.Body).Decode(&placements); err != nil {
+		countError("PutPixelsHandler", "decode")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid request: ", err)
+		return
+	}
+	if len(placements) == 0 {
+		return
+	}
+	if limit := m.maxBatchSize(r); len(placements) > limit {
+		countError("PutPixelsHandler", "batch_size")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "At most %d pixels per request", limit)
+		return
+	}
+
+	key, _ := apiKeyFrom(r.Context())
+	canvas := m.canvas()
+	pixels := make([]SetPixelData, len(placements))
+	for i, p := range placements {
+		section, ok := canvas.sectionAt(p.X, p.Y)
+		if !ok {
+			countError("PutPixelsHandler", "outside_canvas")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Pixel %d: (%d, %d) is outside the canvas", i, p.X, p.Y)
+			return
+		}
+		if key != nil && key.Area != nil && !key.Area.contains(p.X, p.Y) {
+			countError("PutPixelsHandler", "outside_area")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Pixel %d: (%d, %d) is outside the area of the API key", i, p.X, p.Y)
+			return
+		}
+		colorId, err := p.Color.resolve(canvas.colorProvider)
+		if err != nil {
+			countError("PutPixelsHandler", "color")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Pixel %d: %s", i, err)
+			return
+		}
+		pixels[i] = SetPixelData{SecId: section.meta.Id, PixIdx: section.pixIdx(p.X, p.Y), ColorId: colorId}
+	}
+
+	if ok, wait := m.takeRequestLimit(r, len(pixels)); !ok {
+		countError("PutPixelsHandler", "rate_limited")
+		writeRateLimited(w, wait)
+		return
+	}
+	for i, pixel := range pixels {
+		if err := m.placePixel(pixel); err != nil {
+			logger.Error("could not place pixel", "pixel", pixel, "placed", i, "err", err)
+			countError("PutPixelsHandler", "place")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]int{"placed": i})
+			return
+		}
+	}
+	logger.Debug("placed pixels", "count", len(pixels))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"placed": len(pixels)})
+}
+
+// Parses the named query parameters as integers
+func queryInts(r *http.Request, names ...string) ([]int, error) {
+	values := make([]int, len(names))
+	for i, name := range names {
+		v, err := strconv.Atoi(r.URL.Query().Get(name))
+		if err != nil {
+			return nil, fmt.Errorf("query parameter %s must be an integer", name)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+type PixelInfo struct {
+	X       int    `json:"x"`
+	Y       int    `json:"y"`
+	ColorId int    `json:"colorId"`
+	Color   string `json:"color"`
+	SecId   string `json:"secId"`
+	PixIdx  int    `json:"pixIdx"`
+	// Positions whose image covers the pixel
+	Positions []string `json:"positions"`
+}
+
+func GetPixelHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	coords, err := queryInts(r, "x", "y")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	x, y := coords[0], coords[1]
+	canvas := m.canvas()
+	section, ok := canvas.sectionAt(x, y)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "Pixel is outside the canvas")
+		return
+	}
+	if ok, wait := m.takeRequestLimit(r, 1); !ok {
+		countError("GetPixelHandler", "rate_limited")
+		writeRateLimited(w, wait)
+		return
+	}
+
+	data, err := m.store.SectionData(*m.ctx, section.meta.Id)
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not load section data", "secId", section.meta.Id, "err", err)
+		countError("GetPixelHandler", "load")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	bits := canvas.colorProvider.bitsPerColor
+	info := PixelInfo{X: x, Y: y, SecId: section.meta.Id, PixIdx: section.pixIdx(x, y), Positions: []string{}}
+	info.ColorId = getBits(data, info.PixIdx*bits, bits)
+	if color, ok := canvas.colorProvider.colors[info.ColorId]; ok {
+		info.Color = color.hex()
+	}
+	for posId, pos := range canvas.positions {
+		img := pos.ImageInfo
+		if (Area{img.TopLeft, Point{img.TopLeft.X + img.W, img.TopLeft.Y + img.H}}).contains(x, y) {
+			info.Positions = append(info.Positions, posId)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// The color ids currently on the canvas within the area, keepPixel where it
+// is outside the canvas
+func (m *Manager) regionColors(canvas *Canvas, area Area) (*quantizedImage, error) {
+	width, height := area.BotRight.X-area.TopLeft.X, area.BotRight.Y-area.TopLeft.Y
+	region := &quantizedImage{width, height, slices.Repeat([]int{keepPixel}, width*height)}
+	bits := canvas.colorProvider.bitsPerColor
+	for _, section := range canvas.sectionsIn(area) {
+		data, err := m.store.SectionData(*m.ctx, section.meta.Id)
+		if err != nil {
+			return nil, fmt.Errorf("section %s: %w", section.meta.Id, err)
+		}
+		for py := max(section.meta.TopLeft.Y, area.TopLeft.Y); py < min(section.meta.BotRight.Y, area.BotRight.Y); py++ {
+			for px := max(section.meta.TopLeft.X, area.TopLeft.X); px < min(section.meta.BotRight.X, area.BotRight.X); px++ {
+				region.ids[(py-area.TopLeft.Y)*width+px-area.TopLeft.X] = getBits(data, section.pixIdx(px, py)*bits, bits)
+			}
+		}
+	}
+	return region, nil
+}
+
+// Returns the color ids of a rectangle row by row, one byte per pixel (two,
+// big endian, with more than 8 bits per color)
+func GetRegionHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	values, err := queryInts(r, "x", "y", "w", "h")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, err)
+		return
+	}
+	x, y, width, height := values[0], values[1], values[2], values[3]
+	if width <= 0 || height <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Width and height must be positive")
+		return
+	}
+	if width*height > m.config.API.MaxRegionPixels || width > m.config.API.MaxRegionPixels || height > m.config.API.MaxRegionPixels {
+		countError("GetRegionHandler", "too_large")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "At most %d pixels per request", m.config.API.MaxRegionPixels)
+		return
+	}
+	area := Area{Point{x, y}, Point{x + width, y + height}}
+	canvas := m.canvas()
+	covered := 0
+	for _, section := range canvas.sectionsIn(area) {
+		covered += (min(section.meta.BotRight.X, area.BotRight.X) - max(section.meta.TopLeft.X, area.TopLeft.X)) *
+			(min(section.meta.BotRight.Y, area.BotRight.Y) - max(section.meta.TopLeft.Y, area.TopLeft.Y))
+	}
+	if covered != width*height {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Region exceeds the canvas")
+		return
+	}
+	if ok, wait := m.takeRequestLimit(r, 1); !ok {
+		countError("GetRegionHandler", "rate_limited")
+		writeRateLimited(w, wait)
+		return
+	}
+
+	colors, err := m.regionColors(canvas, area)
+	if err != nil {
+		loggerFrom(r.Context()).Error("could not load section data", "err", err)
+		countError("GetRegionHandler", "load")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	bytesPerPixel := 1
+	if canvas.colorProvider.bitsPerColor > 8 {
+		bytesPerPixel = 2
+	}
+	region := make([]byte, width*height*bytesPerPixel)
+	for i, colorId := range colors.ids {
+		if bytesPerPixel == 1 {
+			region[i] = byte(colorId)
+		} else {
+			binary.BigEndian.PutUint16(region[i*2:], uint16(colorId))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Region-Width", strconv.Itoa(width))
+	w.Header().Set("X-Region-Height", strconv.Itoa(height))
+	w.Header().Set("X-Bytes-Per-Pixel", strconv.Itoa(bytesPerPixel))
+	w.Write(region)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+type testPixel struct {
+	X     int `json:"x"`
+	Y     int `json:"y"`
+	Color any `json:"color"`
+}
+
+func TestPutPixelsBroadcastsAndReadsBack(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.login(t, "painter", RolePainter)
+	canvas := srv.manager.canvas()
+	section, _ := canvas.section("1")
+	x, y := section.meta.TopLeft.X+2, section.meta.TopLeft.Y+1
+	hex := canvas.colorProvider.colors[4].hex()
+
+	c := srv.dial(t, "")
+	c.subscribe("1")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("1") == 1 })
+
+	res, body := srv.request(t, http.MethodPut, "/pixels", token, []testPixel{{x, y, 3}, {x + 1, y, hex}})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("put pixels: got %d %q", res.StatusCode, body)
+	}
+	c.expectPixel(SetPixelData{SecId: "1", PixIdx: section.pixIdx(x, y), ColorId: 3})
+	c.expectPixel(SetPixelData{SecId: "1", PixIdx: section.pixIdx(x+1, y), ColorId: 4})
+
+	res, body = srv.request(t, http.MethodGet, fmt.Sprintf("/pixel?x=%d&y=%d", x+1, y), token, nil)
+	var info PixelInfo
+	if res.StatusCode != http.StatusOK || json.Unmarshal(body, &info) != nil {
+		t.Fatalf("get pixel: got %d %q", res.StatusCode, body)
+	}
+	if info.ColorId != 4 || info.Color != hex || info.SecId != "1" {
+		t.Errorf("got %+v", info)
+	}
+
+	res, body = srv.request(t, http.MethodGet, fmt.Sprintf("/region?x=%d&y=%d&w=3&h=2", x-1, y), token, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("get region: got %d %q", res.StatusCode, body)
+	}
+	if want := []byte{0, 3, 4, 0, 0, 0}; string(body) != string(want) {
+		t.Errorf("region: got %v, want %v", body, want)
+	}
+}
+
+func TestInvalidBatchSetsNothing(t *testing.T) {
+	srv := newTestServer(t)
+	token := srv.login(t, "painter", RolePainter)
+	// The first section is in the top left corner of the canvas
+	section, _ := srv.manager.canvas().section("0")
+	x, y := section.meta.TopLeft.X, section.meta.TopLeft.Y
+
+	for name, batch := range map[string][]testPixel{
+		"unknown color":  {{x, y, 1}, {x + 1, y, "#123456"}},
+		"invalid color":  {{x, y, 1}, {x + 1, y, "red"}},
+		"outside canvas": {{x, y, 1}, {x - 1, y, 1}},
+	} {
+		if res, _ := srv.request(t, http.MethodPut, "/pixels", token, batch); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", name, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+	if got := srv.sectionColors(t, "0")[0]; got != 0 {
+		t.Errorf("pixel of a rejected batch was set to %d", got)
+	}
+
+	viewer := srv.login(t, "viewer", RoleViewer)
+	if res, _ := srv.request(t, http.MethodPut, "/pixels", viewer, []testPixel{{x, y, 1}}); res.StatusCode != http.StatusForbidden {
+		t.Errorf("viewer: got %d, want %d", res.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestPixelRateLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.API.PixelsPerSecond = 1
+	cfg.API.PixelBurst = 3
+	srv := newTestServerWithConfig(t, cfg)
+	token := srv.login(t, "painter", RolePainter)
+
+	batch := []testPixel{{0, 0, 1}, {1, 0, 1}, {2, 0, 1}, {3, 0, 1}}
+	if res, _ := srv.request(t, http.MethodPut, "/pixels", token, batch); res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch beyond the burst: got %d, want %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	if res, _ := srv.request(t, http.MethodPut, "/pixels", token, batch[:3]); res.StatusCode != http.StatusOK {
+		t.Fatalf("got %d", res.StatusCode)
+	}
+	res, _ := srv.request(t, http.MethodGet, "/pixel?x=0&y=0", token, nil)
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Errorf("got %d with Retry-After %q, want %d", res.StatusCode, res.Header.Get("Retry-After"), http.StatusTooManyRequests)
+	}
+}
+
+func TestReadsAreServedWhileShuttingDown(t *testing.T) {
+	srv := newTestServer(t)
+	admin := srv.login(t, "admin", RoleAdmin)
+	if err := srv.manager.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, body := srv.request(t, http.MethodGet, "/pixel?x=0&y=0", admin, nil); res.StatusCode != http.StatusOK {
+		t.Errorf("get pixel: got %d %q", res.StatusCode, body)
+	}
+	// Admin jobs aren't started anymore
+	if res, _ := srv.request(t, http.MethodPost, "/update-colors", admin, map[string]any{}); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("update colors: got %d, want %d", res.StatusCode, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// A pubsub connection to one redis instance along with the channels it should be
+// subscribed to. Every shard publishes the pixels placed in a section on the
+// section's own channel, the metadata redis publishes changes to the shard map.
+type pubsubConn struct {
+	name       string
+	client     *redis.Client
+	pubsub     *redis.PubSub
+	channels   []string            // always subscribed
+	sections   map[string]struct{} // sections subscribed to via SubscribeSection
+	subscribed atomic.Bool
+}
+
+// Channels to (re)subscribe to. Must be called with channelsMu held.
+func (conn *pubsubConn) allChannels() []string {
+	channels := append([]string{}, conn.channels...)
+	for secId := range conn.sections {
+		channels = append(channels, REDIS_KEYS.SEC_PIX_CHANNEL(secId))
+	}
+	return channels
+}
+
+// Channels are subscribed to by EnsureSubscribed once redis is reachable
+func (s *RedisStore) setupPubsubs() {
+	metaIsShard := false
+	for _, name := range s.shards.names {
+		client := s.shards.clients[name]
+		conn := &pubsubConn{name: name, client: client, sections: make(map[string]struct{})}
+		if client == s.meta {
+			metaIsShard = true
+			conn.channels = append(conn.channels, shardMapChannel)
+		}
+		s.pubsubs = append(s.pubsubs, conn)
+	}
+	if !metaIsShard {
+		s.pubsubs = append(s.pubsubs, &pubsubConn{name: "meta", client: s.meta, channels: []string{shardMapChannel}, sections: make(map[string]struct{})})
+	}
+
+	for _, conn := range s.pubsubs {
+		conn.pubsub = conn.client.Subscribe(s.ctx)
+		go s.receive(conn)
+	}
+}
+
+// Handles the messages of one pubsub connection until it is closed
+func (s *RedisStore) receive(conn *pubsubConn) {
+	for msg := range conn.pubsub.ChannelWithSubscriptions() {
+		switch payload := msg.(type) {
+		case *redis.Subscription:
+			// Also received after go-redis reconnected and resubscribed on its own
+			slog.Info("pubsub subscription confirmed", "redis", conn.name, "kind", payload.Kind, "channel", payload.Channel)
+			if payload.Kind == "subscribe" {
+				conn.subscribed.Store(true)
+			}
+		case *redis.Message:
+			s.handleMessage(payload)
+		}
+	}
+}
+
+func (s *RedisStore) handleMessage(msg *redis.Message) {
+	slog.Debug("read evt from pubsub-queue", "channel", msg.Channel, "payload", msg.Payload)
+	if msg.Channel == shardMapChannel {
+		metrics.eventsProcessed.WithLabelValues(shardMapChannel, "pubsub").Inc()
+		if err := s.shards.Load(s.ctx); err != nil {
+			slog.Error("could not reload shard map", "err", err)
+			countError("pubsub", "shard_map")
+			return
+		}
+		s.resubscribeMovedSections()
+		return
+	}
+
+	var setPixData SetPixelData
+	if err := json.Unmarshal([]byte(msg.Payload), &setPixData); err != nil {
+		slog.Error("could not unmarshal payload of pubsub evt", "channel", msg.Channel, "err", err)
+		countError("pubsub", "unmarshal")
+		return
+	}
+	// Nobody reads the pixels anymore once the store is closed
+	select {
+	case s.pixels <- setPixData:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *RedisStore) Subscribed() bool {
+	for _, conn := range s.pubsubs {
+		if !conn.subscribed.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *RedisStore) EnsureSubscribed(ctx context.Context) bool {
+	s.channelsMu.Lock()
+	defer s.channelsMu.Unlock()
+
+	for _, conn := range s.pubsubs {
+		if conn.subscribed.Load() {
+			continue
+		}
+		channels := conn.allChannels()
+		if len(channels) == 0 {
+			// Shards without subscribed sections have nothing to subscribe to
+			conn.subscribed.Store(true)
+			continue
+		}
+		// The subscription confirmation is picked up by receive
+		if err := conn.pubsub.Subscribe(ctx, channels...); err != nil {
+			slog.Warn("could not subscribe to pubsub channels", "redis", conn.name, "err", err)
+		}
+	}
+	return s.Subscribed()
+}
+
+func (s *RedisStore) closePubsubs() error {
+	var firstErr error
+	for _, conn := range s.pubsubs {
+		if err := conn.pubsub.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *RedisStore) shardPubsub(name string) *pubsubConn {
+	for _, conn := range s.pubsubs {
+		if conn.name == name {
+			return conn
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) SubscribeSection(ctx context.Context, secId string) error {
+	s.channelsMu.Lock()
+	defer s.channelsMu.Unlock()
+	return s.subscribeSection(ctx, secId, s.shards.Name(secId))
+}
+
+func (s *RedisStore) UnsubscribeSection(ctx context.Context, secId string) error {
+	s.channelsMu.Lock()
+	defer s.channelsMu.Unlock()
+	return s.unsubscribeSection(ctx, secId)
+}
+
+// Follows sections which have been moved to another shard. Called after the shard map changed.
+func (s *RedisStore) resubscribeMovedSections() {
+	s.channelsMu.Lock()
+	defer s.channelsMu.Unlock()
+
+	for secId, shard := range s.channelShards {
+		if newShard := s.shards.Name(secId); newShard != shard {
+			slog.Info("following section to new shard", "secId", secId, "from", shard, "to", newShard)
+			if err := s.unsubscribeSection(s.ctx, secId); err != nil {
+				slog.Warn("could not unsubscribe from section channel", "secId", secId, "redis", shard, "err", err)
+			}
+			if err := s.subscribeSection(s.ctx, secId, newShard); err != nil {
+				slog.Warn("could not subscribe to section channel", "secId", secId, "redis", newShard, "err", err)
+			}
+		}
+	}
+}
+
+// Must be called with channelsMu held. The section is remembered even if
+// subscribing fails, EnsureSubscribed retries once redis is reachable again.
+func (s *RedisStore) subscribeSection(ctx context.Context, secId, shard string) error {
+	conn := s.shardPubsub(shard)
+	conn.sections[secId] = struct{}{}
+	s.channelShards[secId] = shard
+	return conn.pubsub.Subscribe(ctx, REDIS_KEYS.SEC_PIX_CHANNEL(secId))
+}
+
+// Must be called with channelsMu held
+func (s *RedisStore) unsubscribeSection(ctx context.Context, secId string) error {
+	shard, ok := s.channelShards[secId]
+	if !ok {
+		return nil
+	}
+	conn := s.shardPubsub(shard)
+	delete(conn.sections, secId)
+	delete(s.channelShards, secId)
+	return conn.pubsub.Unsubscribe(ctx, REDIS_KEYS.SEC_PIX_CHANNEL(secId))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Color id a quantized pixel has when the canvas is left as it is there
+const keepPixel = -1
+
+// How images are mapped onto the palette
+type Dither string
+
+const (
+	DitherNone           Dither = "nearest"         // every pixel gets its closest color
+	DitherFloydSteinberg Dither = "floyd-steinberg" // error diffusion onto 4 neighbours
+	DitherAtkinson       Dither = "atkinson"        // diffuses only 3/4 of the error, keeps more contrast
+	DitherOrdered        Dither = "ordered"         // 8x8 Bayer matrix, no error travels between pixels
+)
+
+func parseDither(s string) (Dither, error) {
+	switch d := Dither(s); d {
+	case "":
+		return DitherNone, nil
+	case DitherNone, DitherFloydSteinberg, DitherAtkinson, DitherOrdered:
+		return d, nil
+	}
+	return "", fmt.Errorf("unknown dithering %q (expected nearest, floyd-steinberg, atkinson or ordered)", s)
+}
+
+// What happens to the transparent parts of images
+type AlphaMode string
+
+const (
+	AlphaReplace AlphaMode = "replace" // mostly transparent pixels get the default color, the rest is drawn opaque
+	AlphaBlend   AlphaMode = "blend"   // transparent pixels are skipped, translucent ones blended with the canvas
+)
+
+func parseAlphaMode(s string) (AlphaMode, error) {
+	switch mode := AlphaMode(s); mode {
+	case "":
+		return AlphaReplace, nil
+	case AlphaReplace, AlphaBlend:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown alpha mode %q (expected replace or blend)", s)
+}
+
+// Share of a pixel's error passed on to the pixel at dx, dy
+type diffusion struct {
+	dx, dy int
+	weight float64
+}
+
+var diffusionKernels = map[Dither][]diffusion{
+	DitherFloydSteinberg: {{1, 0, 7.0 / 16}, {-1, 1, 3.0 / 16}, {0, 1, 5.0 / 16}, {1, 1, 1.0 / 16}},
+	DitherAtkinson:       {{1, 0, 1.0 / 8}, {2, 0, 1.0 / 8}, {-1, 1, 1.0 / 8}, {0, 1, 1.0 / 8}, {1, 1, 1.0 / 8}, {0, 2, 1.0 / 8}},
+}
+
+var bayer8 = [8][8]float64{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// How quantize maps colors onto the palette
+type quantizeOptions struct {
+	dither Dither
+	metric ColorMetric
+	// Canvas colors under the image to blend translucent pixels with, nil
+	// unless alpha mode is blend
+	background *quantizedImage
+}
+
+// An image mapped onto the palette, row by row
+type quantizedImage struct {
+	width, height int
+	ids           []int
+}
+
+func (q *quantizedImage) at(x, y int) int {
+	return q.ids[y*q.width+x]
+}
+
+func clampByte(v float64) byte {
+	return byte(math.Round(math.Max(0, math.Min(255, v))))
+}
+
+// The color c has over the palette color with the given id, false where
+// nothing would be drawn
+func blend(c color.Color, backgroundId int, cp *ColorProvider) (*Color, bool) {
+	fg := color.NRGBAModel.Convert(c).(color.NRGBA)
+	bg, ok := cp.colors[backgroundId]
+	if fg.A == 0 || !ok {
+		return nil, false
+	}
+	a := int(fg.A)
+	mix := func(f, b byte) byte {
+		return byte((int(f)*a + int(b)*(255-a) + 127) / 255)
+	}
+	return NewColor(mix(fg.R, bg.R), mix(fg.G, bg.G), mix(fg.B, bg.B)), true
+}
+
+// Maps every pixel of img onto a color of the palette
+func quantize(img image.Image, cp *ColorProvider, opts quantizeOptions) (*quantizedImage, error) {
+	dither := opts.dither
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	q := &quantizedImage{w, h, make([]int, w*h)}
+
+	// Error diffused onto the pixels not yet quantized, 3 channels per pixel
+	kernel := diffusionKernels[dither]
+	var diffused []float64
+	if kernel != nil {
+		diffused = make([]float64, w*h*3)
+	}
+	// Ordered dithering spreads the thresholds over about one step between palette colors
+	spread := 255 / math.Max(1, math.Cbrt(float64(len(cp.colors))))
+
+	for y := range h {
+		for x := range w {
+			pixel := img.At(bounds.Min.X+x, bounds.Min.Y+y)
+			c := FromColor(pixel)
+			if opts.background != nil {
+				var ok bool
+				if c, ok = blend(pixel, opts.background.at(x, y), cp); !ok {
+					q.ids[y*w+x] = keepPixel
+					continue
+				}
+			}
+			want := [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+			switch {
+			case kernel != nil:
+				for i := range want {
+					want[i] += diffused[(y*w+x)*3+i]
+				}
+			case dither == DitherOrdered:
+				offset := (bayer8[y%8][x%8]/64 - 0.5) * spread
+				for i := range want {
+					want[i] += offset
+				}
+			}
+
+			id, err := cp.ClosestColor(NewRGBAColor(clampByte(want[0]), clampByte(want[1]), clampByte(want[2]), c.A), opts.metric)
+			if err != nil {
+				return nil, err
+			}
+			q.ids[y*w+x] = id
+
+			// Transparent pixels have no color whose error could be passed on
+			if kernel == nil || c.A < 50 {
+				continue
+			}
+			got := cp.colors[id]
+			errs := [3]float64{want[0] - float64(got.R), want[1] - float64(got.G), want[2] - float64(got.B)}
+			for _, d := range kernel {
+				nx, ny := x+d.dx, y+d.dy
+				if nx < 0 || nx >= w || ny >= h {
+					continue
+				}
+				for i := range errs {
+					diffused[(ny*w+nx)*3+i] += errs[i] * d.weight
+				}
+			}
+		}
+	}
+	return q, nil
+}
+
+// The image as it will look on the canvas, kept pixels are transparent
+func (q *quantizedImage) preview(cp *ColorProvider) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, q.width, q.height))
+	for y := range q.height {
+		for x := range q.width {
+			if c, ok := cp.colors[q.at(x, y)]; ok {
+				img.SetNRGBA(x, y, color.NRGBA{c.R, c.G, c.B, 255})
+			}
+		}
+	}
+	return img
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestDitheringMixesColors(t *testing.T) {
+	cp := NewColorProvider(1, NewColor(0, 0, 0), NewColor(255, 255, 255))
+	gray := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(gray, gray.Bounds(), &image.Uniform{color.RGBA{128, 128, 128, 255}}, image.Point{}, draw.Src)
+
+	whiteShare := func(dither Dither) float64 {
+		q, err := quantize(gray, cp, quantizeOptions{dither: dither, metric: MetricRGB})
+		if err != nil {
+			t.Fatal(err)
+		}
+		white := 0
+		for _, id := range q.ids {
+			if cp.colors[id].R == 255 {
+				white++
+			}
+		}
+		return float64(white) / float64(len(q.ids))
+	}
+
+	if share := whiteShare(DitherNone); share != 0 && share != 1 {
+		t.Errorf("nearest mixed colors: %.2f white", share)
+	}
+	for _, dither := range []Dither{DitherFloydSteinberg, DitherAtkinson, DitherOrdered} {
+		if share := whiteShare(dither); share < 0.4 || share > 0.6 {
+			t.Errorf("%s: %.2f white, want about half", dither, share)
+		}
+	}
+}
+
+func TestParseDither(t *testing.T) {
+	if d, err := parseDither(""); err != nil || d != DitherNone {
+		t.Errorf("default: got %q, %v", d, err)
+	}
+	if _, err := parseDither("riemersma"); err == nil {
+		t.Error("unknown dithering was accepted")
+	}
+}
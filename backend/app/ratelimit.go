@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Token bucket, refilled at `rate` tokens per second up to `burst`
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// Takes n tokens if there are enough, otherwise returns how long until there will be
+func (b *tokenBucket) take(now time.Time, n float64) (bool, time.Duration) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if n > b.burst {
+		return false, 0
+	}
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	wait := time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
+
+// Buckets are dropped once there are this many and they have refilled completely,
+// they would be recreated full anyway
+const maxIdleBuckets = 10_000
+
+// One bucket per key (API key id, username, client address, ...). Limits are per replica.
+type rateLimiters struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiters() *rateLimiters {
+	return &rateLimiters{buckets: make(map[string]*tokenBucket)}
+}
+
+// Takes n tokens from the bucket of key, which is created full. Changed limits
+// apply to existing buckets right away.
+func (l *rateLimiters) take(key string, rate float64, burst int, n int) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.prune(now)
+		}
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.rate, b.burst = rate, float64(burst)
+	return b.take(now, float64(n))
+}
+
+// Must be called with mu held
+func (l *rateLimiters) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiters) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
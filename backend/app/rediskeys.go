@@ -15,6 +15,14 @@ var REDIS_KEYS = struct {
 	SEC_IDS         string
 	SEC_META        func(string) string
 	SEC_PIX_DATA    func(string) string
+	SHARD_MAP       string
+	MIGRATION_STATE func(string) string
+	MIGRATION_LOG   func(string) string
+	SEC_PIX_CHANNEL func(string) string
+	REFRESH_TOKEN   func(string) string
+	REVOKED_TOKEN   func(string) string
+	API_KEY_IDS     string
+	API_KEY         func(string) string
 }{
 	"total_nr_pixels",
 	"bits_per_color",
@@ -34,4 +42,24 @@ var REDIS_KEYS = struct {
 	func(id string) string {
 		return id
 	},
+	"shard_map",
+	func(id string) string {
+		return fmt.Sprint("migration_", id)
+	},
+	func(id string) string {
+		return fmt.Sprint("migration_log_", id)
+	},
+	func(id string) string {
+		return fmt.Sprint("set_pixel:", id)
+	},
+	func(id string) string {
+		return fmt.Sprint("refresh_token:", id)
+	},
+	func(jti string) string {
+		return fmt.Sprint("revoked_token:", jti)
+	},
+	"api_key_ids",
+	func(id string) string {
+		return fmt.Sprint("api_key:", id)
+	},
 }
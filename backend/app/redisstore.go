@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var _ CanvasStore = (*RedisStore)(nil)
+
+// Keeps the metadata (sections, colors, positions, users, shard map) in one redis
+// and the pixel data of the sections spread over the shards
+type RedisStore struct {
+	meta          *redis.Client
+	shards        *Shards
+	ctx           context.Context
+	cancel        context.CancelFunc // cancels ctx once the store is closed
+	pubsubs       []*pubsubConn
+	channelsMu    sync.Mutex
+	channelShards map[string]string // secId -> shard whose channel for the section we're subscribed to
+	pixels        chan SetPixelData
+}
+
+func NewRedisStore(cfg *Config) *RedisStore {
+	meta := newRedisClient(cfg.Redis.Addr, cfg.Redis.Password, cfg.Redis.DB)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &RedisStore{
+		meta:          meta,
+		shards:        NewShards(meta, cfg.Redis.Shards),
+		ctx:           ctx,
+		cancel:        cancel,
+		channelShards: make(map[string]string),
+		pixels:        make(chan SetPixelData, 100),
+	}
+	s.setupPubsubs()
+	return s
+}
+
+func (s *RedisStore) Open(ctx context.Context) error {
+	if err := s.shards.Load(ctx); err != nil {
+		slog.Error("could not load shard map", "err", err)
+		return err
+	}
+	return nil
+}
+
+// Pings every redis the store uses
+func (s *RedisStore) Ping(ctx context.Context) error {
+	err := s.meta.Ping(ctx).Err()
+	for name, shard := range s.shards.All() {
+		if err != nil {
+			break
+		}
+		if shardErr := shard.Ping(ctx).Err(); shardErr != nil {
+			err = fmt.Errorf("shard %s: %w", name, shardErr)
+		}
+	}
+	if err != nil {
+		for _, conn := range s.pubsubs {
+			conn.subscribed.Store(false)
+		}
+	}
+	return err
+}
+
+func (s *RedisStore) Reset(ctx context.Context) error {
+	for name, shard := range s.shards.All() {
+		if err := deleteCanvasKeys(ctx, shard); err != nil {
+			return fmt.Errorf("shard %s: %w", name, err)
+		}
+	}
+	return deleteCanvasKeys(ctx, s.meta)
+}
+
+// Keys which survive a reset
+var accountKeyPrefixes = []string{"user:", REDIS_KEYS.REFRESH_TOKEN(""), REDIS_KEYS.REVOKED_TOKEN(""), REDIS_KEYS.API_KEY_IDS, REDIS_KEYS.API_KEY("")}
+
+// Deletes everything but the accounts (a shard may share its database with the metadata)
+func deleteCanvasKeys(ctx context.Context, client *redis.Client) error {
+	iter := client.Scan(ctx, 0, "*", 1000).Iterator()
+	keys := make([]string, 0, 1000)
+	for iter.Next(ctx) {
+		if slices.ContainsFunc(accountKeyPrefixes, func(prefix string) bool { return strings.HasPrefix(iter.Val(), prefix) }) {
+			continue
+		}
+		keys = append(keys, iter.Val())
+		if len(keys) == cap(keys) {
+			if err := client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return client.Del(ctx, keys...).Err()
+	}
+	return nil
+}
+
+// Closes the pubsubs and the connections to redis
+func (s *RedisStore) Close() error {
+	s.cancel()
+	if err := s.closePubsubs(); err != nil {
+		slog.Warn("could not close pubsub", "err", err)
+	}
+	if err := s.shards.Close(); err != nil {
+		slog.Warn("could not close shard connections", "err", err)
+	}
+	return s.meta.Close()
+}
+
+func (s *RedisStore) SectionsMeta(ctx context.Context) ([]SectionMetaData, error) {
+	sectionIds, err := s.meta.SMembers(ctx, REDIS_KEYS.SEC_IDS).Result()
+	if err != nil {
+		slog.Error("error when getting key", "key", REDIS_KEYS.SEC_IDS, "err", err)
+		return nil, err
+	}
+	sections := make([]SectionMetaData, len(sectionIds))
+	for i, id := range sectionIds {
+		binary, err := s.meta.Get(ctx, REDIS_KEYS.SEC_META(id)).Bytes()
+		if err != nil {
+			slog.Error("error when getting key", "key", REDIS_KEYS.SEC_META(id), "err", err)
+			return nil, err
+		}
+		if err := json.Unmarshal(binary, &sections[i]); err != nil {
+			slog.Error("could not unmarshal", "err", err)
+			return nil, err
+		}
+	}
+	return sections, nil
+}
+
+func (s *RedisStore) SaveSectionsMeta(ctx context.Context, sections []SectionMetaData) error {
+	s.meta.Del(ctx, REDIS_KEYS.SEC_IDS)
+	for _, meta := range sections {
+		bytes, err := json.Marshal(meta)
+		if err != nil {
+			slog.Error("could not marshal section meta data", "err", err)
+			return err
+		}
+		s.meta.Set(ctx, REDIS_KEYS.SEC_META(meta.Id), bytes, 0)
+		s.meta.SAdd(ctx, REDIS_KEYS.SEC_IDS, meta.Id)
+	}
+	return nil
+}
+
+func (s *RedisStore) SectionData(ctx context.Context, secId string) ([]byte, error) {
+	data, err := s.shards.For(secId).Get(ctx, REDIS_KEYS.SEC_PIX_DATA(secId)).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("shard %s: %w", s.shards.Name(secId), err)
+	}
+	return data, nil
+}
+
+func (s *RedisStore) SaveSectionData(ctx context.Context, secId string, data []byte) error {
+	return s.shards.For(secId).Set(ctx, REDIS_KEYS.SEC_PIX_DATA(secId), data, 0).Err()
+}
+
+// Writes a pixel unless the section is being moved away from the shard (see
+// moveSection), logging it while the section's data is being copied
+var setPixelScript = redis.NewScript(`
+local state = redis.call('GET', KEYS[2])
+if state == 'fenced' then
+	return redis.error_reply('FENCED section is being moved to another shard')
+end
+redis.call('BITFIELD', KEYS[1], 'SET', ARGV[1], ARGV[2], ARGV[3])
+if state == 'logging' then
+	redis.call('RPUSH', KEYS[3], ARGV[4])
+end
+return 1
+`)
+
+// How long a write waits for a section which is being moved to arrive on its new shard
+const movingSectionWait = 5 * time.Second
+
+func (s *RedisStore) SetPixel(ctx context.Context, bitsPerColor int, setPixData SetPixelData) error {
+	secId := setPixData.SecId
+	keys := []string{REDIS_KEYS.SEC_PIX_DATA(secId), REDIS_KEYS.MIGRATION_STATE(secId), REDIS_KEYS.MIGRATION_LOG(secId)}
+	entry, err := json.Marshal(setPixData)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(movingSectionWait)
+	for {
+		err := setPixelScript.Run(ctx, s.shards.For(secId), keys, fmt.Sprintf("u%d", bitsPerColor), fmt.Sprintf("#%d", setPixData.PixIdx), setPixData.ColorId, entry).Err()
+		if !redis.HasErrorPrefix(err, "FENCED") {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("section %s is still being moved: %w", secId, err)
+		}
+		// Either the move isn't finished yet or we missed the new shard map
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+		if err := s.shards.Load(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// Counts how often a section has been served
+func (s *RedisStore) CountSectionServed(ctx context.Context, secId string) error {
+	return s.meta.HIncrBy(ctx, "section_counts", secId, 1).Err()
+}
+
+func (s *RedisStore) Palette(ctx context.Context) (int, []ColorChoice, error) {
+	bitsPerColor, err := s.meta.Get(ctx, REDIS_KEYS.BITS_PER_COLOR).Int()
+	if err != nil {
+		slog.Error("error when getting key", "key", REDIS_KEYS.BITS_PER_COLOR, "err", err)
+		return 0, nil, err
+	}
+	colorSet, err := s.meta.SMembers(ctx, REDIS_KEYS.COLOR_SET).Result()
+	if err != nil {
+		slog.Error("error when getting key", "key", REDIS_KEYS.COLOR_SET, "err", err)
+		return 0, nil, err
+	}
+
+	colors := make([]ColorChoice, 0, len(colorSet))
+	for _, binary := range colorSet {
+		var colorChoice ColorChoice
+		if err := json.Unmarshal([]byte(binary), &colorChoice); err != nil {
+			slog.Warn("could not unmarshal color", "err", err)
+			continue
+		}
+		colors = append(colors, colorChoice)
+	}
+	return bitsPerColor, colors, nil
+}
+
+func (s *RedisStore) SavePalette(ctx context.Context, bitsPerColor int, colors []ColorChoice) error {
+	s.meta.Del(ctx, REDIS_KEYS.COLOR_SET)
+	s.meta.Set(ctx, REDIS_KEYS.BITS_PER_COLOR, bitsPerColor, 0)
+	for _, colorChoice := range colors {
+		bytes, err := json.Marshal(colorChoice)
+		if err != nil {
+			slog.Error("could not marshal color", "err", err)
+			return err
+		}
+		s.meta.SAdd(ctx, REDIS_KEYS.COLOR_SET, bytes)
+	}
+	return nil
+}
+
+func (s *RedisStore) Positions(ctx context.Context) (map[string]PositionInfo, error) {
+	positionIds, err := s.meta.SMembers(ctx, REDIS_KEYS.POS_IDS).Result()
+	if err != nil {
+		slog.Error("error when getting key", "key", REDIS_KEYS.POS_IDS, "err", err)
+		return nil, err
+	}
+	positions := make(map[string]PositionInfo)
+	for _, id := range positionIds {
+		binary, err := s.meta.Get(ctx, REDIS_KEYS.POSITION(id)).Bytes()
+		if err != nil {
+			slog.Error("error when getting key", "key", REDIS_KEYS.POSITION(id), "err", err)
+			return nil, err
+		}
+		var info = PositionInfo{}
+		if err := json.Unmarshal(binary, &info); err != nil {
+			slog.Error("could not unmarshal", "err", err)
+			return nil, err
+		}
+		positions[id] = info
+	}
+	return positions, nil
+}
+
+func (s *RedisStore) SavePosition(ctx context.Context, posId string, pos PositionInfo) error {
+	bytes, err := json.Marshal(pos)
+	if err != nil {
+		return err
+	}
+	pipe := s.meta.TxPipeline()
+	pipe.Set(ctx, REDIS_KEYS.POSITION(posId), bytes, 0)
+	pipe.SAdd(ctx, REDIS_KEYS.POS_IDS, posId)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) DeletePosition(ctx context.Context, posId string) error {
+	pipe := s.meta.TxPipeline()
+	pipe.Del(ctx, REDIS_KEYS.POSITION(posId))
+	pipe.SRem(ctx, REDIS_KEYS.POS_IDS, posId)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) User(ctx context.Context, username string) (User, error) {
+	var user User
+	key := fmt.Sprintf("user:%s", username)
+	if res, err := s.meta.Exists(ctx, key).Result(); err != nil {
+		return User{}, err
+	} else if res == 0 {
+		return User{}, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	if err := s.meta.HGetAll(ctx, key).Scan(&user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *RedisStore) SaveUser(ctx context.Context, user User) error {
+	key := fmt.Sprintf("user:%s", user.Username)
+	pipe := s.meta.TxPipeline()
+	pipe.HSet(ctx, key, "username", user.Username, "passwordHash", user.PasswordHash, "role", string(user.Role), "tokenGeneration", user.TokenGeneration)
+	if user.Password == "" {
+		pipe.HDel(ctx, key, "password")
+	} else {
+		pipe.HSet(ctx, key, "password", string(user.Password))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) CreateUser(ctx context.Context, user User) error {
+	// Claims the name first, so that concurrent registrations can't overwrite each other
+	key := fmt.Sprintf("user:%s", user.Username)
+	created, err := s.meta.HSetNX(ctx, key, "username", user.Username).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("%w: %s", ErrUserExists, user.Username)
+	}
+	return s.SaveUser(ctx, user)
+}
+
+func (s *RedisStore) SaveRefreshToken(ctx context.Context, id string, token RefreshToken) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.meta.SetArgs(ctx, REDIS_KEYS.REFRESH_TOKEN(id), b, redis.SetArgs{ExpireAt: token.ExpiresAt}).Err()
+}
+
+func (s *RedisStore) TakeRefreshToken(ctx context.Context, id string) (RefreshToken, error) {
+	b, err := s.meta.GetDel(ctx, REDIS_KEYS.REFRESH_TOKEN(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return RefreshToken{}, ErrTokenUnknown
+	} else if err != nil {
+		return RefreshToken{}, err
+	}
+	var token RefreshToken
+	if err := json.Unmarshal(b, &token); err != nil {
+		return RefreshToken{}, err
+	}
+	if token.expired() {
+		return RefreshToken{}, ErrTokenUnknown
+	}
+	return token, nil
+}
+
+func (s *RedisStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if time.Now().After(expiresAt) {
+		return nil
+	}
+	return s.meta.SetArgs(ctx, REDIS_KEYS.REVOKED_TOKEN(jti), 1, redis.SetArgs{ExpireAt: expiresAt}).Err()
+}
+
+func (s *RedisStore) TokenRevoked(ctx context.Context, jti string) (bool, error) {
+	n, err := s.meta.Exists(ctx, REDIS_KEYS.REVOKED_TOKEN(jti)).Result()
+	return n > 0, err
+}
+
+func (s *RedisStore) SaveAPIKey(ctx context.Context, key APIKey) error {
+	b, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	pipe := s.meta.TxPipeline()
+	pipe.Set(ctx, REDIS_KEYS.API_KEY(key.Id), b, 0)
+	pipe.SAdd(ctx, REDIS_KEYS.API_KEY_IDS, key.Id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisStore) APIKey(ctx context.Context, id string) (APIKey, error) {
+	b, err := s.meta.Get(ctx, REDIS_KEYS.API_KEY(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	} else if err != nil {
+		return APIKey{}, err
+	}
+	var key APIKey
+	err = json.Unmarshal(b, &key)
+	return key, err
+}
+
+func (s *RedisStore) APIKeys(ctx context.Context) ([]APIKey, error) {
+	ids, err := s.meta.SMembers(ctx, REDIS_KEYS.API_KEY_IDS).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, 0, len(ids))
+	for _, id := range ids {
+		key, err := s.APIKey(ctx, id)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (s *RedisStore) DeleteAPIKey(ctx context.Context, id string) error {
+	pipe := s.meta.TxPipeline()
+	deleted := pipe.Del(ctx, REDIS_KEYS.API_KEY(id))
+	pipe.SRem(ctx, REDIS_KEYS.API_KEY_IDS, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if deleted.Val() == 0 {
+		return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	return nil
+}
+
+func (s *RedisStore) PublishPixel(ctx context.Context, setPixData SetPixelData) error {
+	return s.shards.For(setPixData.SecId).Publish(ctx, REDIS_KEYS.SEC_PIX_CHANNEL(setPixData.SecId), setPixData).Err()
+}
+
+func (s *RedisStore) Pixels() <-chan SetPixelData {
+	return s.pixels
+}
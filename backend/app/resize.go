@@ -1,15 +1,135 @@
 package main
 
 import (
+	"fmt"
 	"image"
+	"math"
 
 	"golang.org/x/image/draw"
 )
 
+// How images are resampled when they are drawn at another size
+type Resample string
+
+const (
+	ResampleAuto       Resample = "auto"        // nearest for pixel art and integer upscaling, area or catmull-rom otherwise
+	ResampleNearest    Resample = "nearest"     // keeps hard edges
+	ResampleBilinear   Resample = "bilinear"    // smooth, blurs when shrinking a lot
+	ResampleCatmullRom Resample = "catmull-rom" // sharpest smooth interpolation, slowest
+	ResampleArea       Resample = "area"        // averages the covered source pixels, best for shrinking photos
+)
+
+func parseResample(s string) (Resample, error) {
+	switch resample := Resample(s); resample {
+	case "":
+		return ResampleAuto, nil
+	case ResampleAuto, ResampleNearest, ResampleBilinear, ResampleCatmullRom, ResampleArea:
+		return resample, nil
+	}
+	return "", fmt.Errorf("unknown resampling %q (expected auto, nearest, bilinear, catmull-rom or area)", s)
+}
+
+// Box kernel, x/image/draw widens it to the covered source pixels when shrinking
+var areaAverage = &draw.Kernel{Support: 0.5, At: func(t float64) float64 { return 1 }}
+
+var scalers = map[Resample]draw.Scaler{
+	ResampleNearest:    draw.NearestNeighbor,
+	ResampleBilinear:   draw.BiLinear,
+	ResampleCatmullRom: draw.CatmullRom,
+	ResampleArea:       areaAverage,
+}
+
+// How an image is fitted into the width and height it is drawn at when both are given
+type FitMode string
+
+const (
+	FitStretch FitMode = "stretch" // scales to exactly that size, ignoring the aspect ratio
+	FitContain FitMode = "fit"     // scales proportionally to fit into it, one side may end up shorter
+	FitCover   FitMode = "fill"    // scales proportionally to cover it, the overflow is cut off evenly
+	FitCrop    FitMode = "crop"    // doesn't scale, cuts that much out of the center of the image
+)
+
+func parseFitMode(s string) (FitMode, error) {
+	switch fit := FitMode(s); fit {
+	case "":
+		return FitStretch, nil
+	case FitStretch, FitContain, FitCover, FitCrop:
+		return fit, nil
+	}
+	return "", fmt.Errorf("unknown fit mode %q (expected stretch, fit, fill or crop)", s)
+}
+
+// Part of the source image which is drawn at w x h
+type imageLayout struct {
+	src  image.Rectangle
+	w, h int
+}
+
+func (l imageLayout) scaled() bool {
+	return l.src.Dx() != l.w || l.src.Dy() != l.h
+}
+
+// Rectangle of the given size in the center of r
+func centered(r image.Rectangle, w, h int) image.Rectangle {
+	topLeft := r.Min.Add(image.Pt((r.Dx()-w)/2, (r.Dy()-h)/2))
+	return image.Rectangle{topLeft, topLeft.Add(image.Pt(w, h))}
+}
+
+// Scales bounds into w x h according to the fit mode
+func fitInto(bounds image.Rectangle, w, h int, fit FitMode) imageLayout {
+	sx, sy := float64(w)/float64(bounds.Dx()), float64(h)/float64(bounds.Dy())
+	switch fit {
+	case FitContain:
+		scale := min(sx, sy)
+		return imageLayout{bounds, max(1, int(math.Round(float64(bounds.Dx())*scale))), max(1, int(math.Round(float64(bounds.Dy())*scale)))}
+	case FitCover:
+		scale := max(sx, sy)
+		srcW := min(bounds.Dx(), max(1, int(math.Round(float64(w)/scale))))
+		srcH := min(bounds.Dy(), max(1, int(math.Round(float64(h)/scale))))
+		return imageLayout{centered(bounds, srcW, srcH), w, h}
+	case FitCrop:
+		w, h = min(w, bounds.Dx()), min(h, bounds.Dy())
+		return imageLayout{centered(bounds, w, h), w, h}
+	}
+	return imageLayout{bounds, w, h}
+}
+
+// Whether the image has at most limit distinct colors, as pixel art does
+func fewColors(img image.Image, r image.Rectangle, limit int) bool {
+	seen := make(map[Color]struct{}, limit)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			seen[*FromColor(img.At(x, y))] = struct{}{}
+			if len(seen) > limit {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func chooseResample(img image.Image, l imageLayout) Resample {
+	integerScale := l.w%l.src.Dx() == 0 && l.h%l.src.Dy() == 0
+	switch {
+	case integerScale || fewColors(img, l.src, 64):
+		return ResampleNearest
+	case l.w < l.src.Dx() || l.h < l.src.Dy():
+		return ResampleArea
+	}
+	return ResampleCatmullRom
+}
+
 // http://golang.org/doc/articles/image_draw.html
-func ResizeImage(old image.Image, w, h int) (image.Image, error) {
-	new := image.NewRGBA(image.Rect(0, 0, w, h))
-	draw.BiLinear.Scale(new, new.Bounds(), old, old.Bounds(), draw.Over, nil)
+func ResizeImage(old image.Image, l imageLayout, resample Resample) (image.Image, error) {
+	if resample == ResampleAuto {
+		resample = chooseResample(old, l)
+	}
+	scaler, ok := scalers[resample]
+	if !ok {
+		return nil, fmt.Errorf("unknown resampling %q", resample)
+	}
+	new := image.NewRGBA(image.Rect(0, 0, l.w, l.h))
+	scaler.Scale(new, new.Bounds(), old, l.src, draw.Src, nil)
 
 	return new, nil
 }
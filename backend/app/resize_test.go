@@ -0,0 +1,98 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Black and white squares of the given size
+func checkerboard(w, h, square int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := color.RGBA{0, 0, 0, 255}
+			if (x/square+y/square)%2 == 1 {
+				c = color.RGBA{255, 255, 255, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func distinctColors(img image.Image) int {
+	seen := map[color.Color]bool{}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			seen[img.At(x, y)] = true
+		}
+	}
+	return len(seen)
+}
+
+func TestResizeKeepsPixelArtEdges(t *testing.T) {
+	art := checkerboard(8, 8, 1)
+	for _, tc := range []struct {
+		resample Resample
+		w, h     int
+		sharp    bool
+	}{
+		{ResampleAuto, 24, 24, true},
+		{ResampleAuto, 20, 12, true},
+		{ResampleNearest, 20, 12, true},
+		{ResampleBilinear, 20, 12, false},
+		{ResampleCatmullRom, 20, 12, false},
+	} {
+		img, err := ResizeImage(art, imageLayout{art.Bounds(), tc.w, tc.h}, tc.resample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sharp := distinctColors(img) == 2; sharp != tc.sharp {
+			t.Errorf("%s to %dx%d: %d colors", tc.resample, tc.w, tc.h, distinctColors(img))
+		}
+	}
+}
+
+func TestResizeAreaAverages(t *testing.T) {
+	img, err := ResizeImage(checkerboard(16, 16, 1), imageLayout{image.Rect(0, 0, 16, 16), 4, 4}, ResampleArea)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := range 4 {
+		for x := range 4 {
+			if c := FromColor(img.At(x, y)); c.R < 120 || c.R > 136 {
+				t.Fatalf("(%d, %d) is %+v, want gray", x, y, c)
+			}
+		}
+	}
+}
+
+func TestImageLayout(t *testing.T) {
+	bounds := image.Rect(0, 0, 200, 100)
+	for _, tc := range []struct {
+		in   ImgLoadInstructions
+		want imageLayout
+	}{
+		{ImgLoadInstructions{}, imageLayout{bounds, 200, 100}},
+		{ImgLoadInstructions{W: 50}, imageLayout{bounds, 50, 25}},
+		{ImgLoadInstructions{H: 50}, imageLayout{bounds, 100, 50}},
+		{ImgLoadInstructions{W: 50, H: 50}, imageLayout{bounds, 50, 50}},
+		{ImgLoadInstructions{W: 50, H: 50, Fit: "fit"}, imageLayout{bounds, 50, 25}},
+		{ImgLoadInstructions{W: 50, H: 50, Fit: "fill"}, imageLayout{image.Rect(50, 0, 150, 100), 50, 50}},
+		{ImgLoadInstructions{W: 50, H: 50, Fit: "crop"}, imageLayout{image.Rect(75, 25, 125, 75), 50, 50}},
+		{ImgLoadInstructions{W: 300, H: 50, Fit: "crop"}, imageLayout{image.Rect(0, 25, 200, 75), 200, 50}},
+	} {
+		got, err := tc.in.layout(bounds)
+		if err != nil || got != tc.want {
+			t.Errorf("%+v: got %+v, %v, want %+v", tc.in, got, err, tc.want)
+		}
+	}
+
+	for _, in := range []ImgLoadInstructions{{W: 10, H: 10, Fit: "zoom"}, {W: -10}} {
+		if _, err := in.layout(bounds); err == nil {
+			t.Errorf("%+v was accepted", in)
+		}
+	}
+}
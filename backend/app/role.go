@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+type Role string
+
+const (
+	RoleViewer    Role = "viewer"
+	RolePainter   Role = "painter"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// What a role may do via the authorized endpoints
+type Permission string
+
+const (
+	PermRead          Permission = "read"           // reading the canvas
+	PermPlace         Permission = "place"          // setting pixels
+	PermModerate      Permission = "moderate"       // removing positions and the images placed at them
+	PermLoadImage     Permission = "load_image"     // drawing images from files on the server
+	PermManagePalette Permission = "manage_palette" // replacing the colors
+	PermManageUsers   Permission = "manage_users"   // changing roles, creating and revoking API keys
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleViewer:    {PermRead},
+	RolePainter:   {PermRead, PermPlace},
+	RoleModerator: {PermRead, PermPlace, PermModerate},
+	RoleAdmin:     {PermRead, PermPlace, PermModerate, PermLoadImage, PermManagePalette, PermManageUsers},
+}
+
+// Role of users who registered themselves
+const defaultRole = RolePainter
+
+func parseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, ok := rolePermissions[role]; !ok {
+		return "", fmt.Errorf("unknown role %q (expected viewer, painter, moderator or admin)", s)
+	}
+	return role, nil
+}
+
+// Unknown (and missing) roles can't do anything
+func (r Role) Can(perm Permission) bool {
+	return slices.Contains(rolePermissions[r], perm)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// What a client left behind when its connection dropped. If it reconnects with the
+// session's token within the resume window, its subscriptions get restored and it
+// receives the events it missed in the meantime.
+type Session struct {
+	token      string
+	sections   map[string]struct{}
+	missed     [][]byte
+	detachedAt time.Time
+	// Closed once the writer of the client's connection stopped, a message it
+	// failed to write is in missed by then
+	flushed <-chan struct{}
+}
+
+// Keeps track of the sessions of disconnected clients. Sessions only live in the
+// memory of the replica the client was connected to; a client reconnecting to a
+// different replica starts a fresh session.
+type Sessions struct {
+	sync.Mutex
+	window      time.Duration
+	maxBuffered int
+	byToken     map[string]*Session
+	bySection   map[string]map[*Session]struct{}
+	onRelease   func(sections ...string) // called (on its own goroutine) with the sections of sessions which are dropped
+}
+
+func NewSessions(window time.Duration, maxBuffered int, onRelease func(sections ...string)) *Sessions {
+	return &Sessions{
+		window:      window,
+		maxBuffered: maxBuffered,
+		onRelease:   onRelease,
+		byToken:     make(map[string]*Session),
+		bySection:   make(map[string]map[*Session]struct{}),
+	}
+}
+
+func newSessionToken() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Keeps the subscriptions of a disconnected client around for the resume window,
+// together with the events that were queued for it but never written
+func (s *Sessions) Detach(token string, sections map[string]struct{}, missed [][]byte, flushed <-chan struct{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	session := &Session{
+		token:      token,
+		sections:   make(map[string]struct{}, len(sections)),
+		missed:     missed,
+		detachedAt: time.Now(),
+		flushed:    flushed,
+	}
+	for secId := range sections {
+		session.sections[secId] = struct{}{}
+	}
+	s.add(session)
+	if len(missed) > s.maxBuffered {
+		s.drop(session)
+	}
+}
+
+// Puts events in front of those the session already missed
+func (s *Sessions) Prepend(token string, missed [][]byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	session, ok := s.byToken[token]
+	if !ok {
+		return
+	}
+	session.missed = append(slices.Clone(missed), session.missed...)
+	if len(session.missed) > s.maxBuffered {
+		s.drop(session)
+	}
+}
+
+// Waits (at most for the timeout) until the previous connection of the session
+// handed back what it couldn't write
+func (s *Sessions) AwaitFlushed(token string, timeout time.Duration) {
+	s.Lock()
+	session, ok := s.byToken[token]
+	s.Unlock()
+	if !ok || session.flushed == nil {
+		return
+	}
+	select {
+	case <-session.flushed:
+	case <-time.After(timeout):
+	}
+}
+
+// Puts back a session handed out by Resume which couldn't be attached after all
+func (s *Sessions) Restore(session *Session) {
+	s.Lock()
+	defer s.Unlock()
+	s.add(session)
+}
+
+func (s *Sessions) add(session *Session) {
+	for secId := range session.sections {
+		if s.bySection[secId] == nil {
+			s.bySection[secId] = make(map[*Session]struct{})
+		}
+		s.bySection[secId][session] = struct{}{}
+	}
+	s.byToken[session.token] = session
+	metrics.detachedSessions.Set(float64(len(s.byToken)))
+}
+
+// Hands out the session belonging to the token (if it is still resumable) and
+// stops buffering events for it
+func (s *Sessions) Resume(token string) (*Session, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	session, ok := s.byToken[token]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(session.detachedAt) > s.window {
+		s.drop(session)
+		return nil, false
+	}
+	s.remove(session)
+	return session, true
+}
+
+// Buffers an event for every detached session subscribed to the section. Sessions
+// which missed more events than can be buffered are dropped; their clients will
+// have to start cold.
+func (s *Sessions) Buffer(secId string, evt []byte) {
+	s.Lock()
+	defer s.Unlock()
+
+	for session := range s.bySection[secId] {
+		if len(session.missed) >= s.maxBuffered {
+			slog.Debug("dropping session after missing too many events", "secId", secId)
+			s.drop(session)
+			continue
+		}
+		session.missed = append(session.missed, evt)
+	}
+}
+
+// Drops the sessions which can no longer be resumed
+func (s *Sessions) Expire(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, session := range s.byToken {
+		if now.Sub(session.detachedAt) > s.window {
+			s.drop(session)
+		}
+	}
+}
+
+// Removes a session which won't be resumed. Releasing its sections may take a
+// round trip to the store, which mustn't hold up fanning out pixels.
+func (s *Sessions) drop(session *Session) {
+	s.remove(session)
+	sections := make([]string, 0, len(session.sections))
+	for secId := range session.sections {
+		sections = append(sections, secId)
+	}
+	if len(sections) > 0 {
+		go s.onRelease(sections...)
+	}
+}
+
+func (s *Sessions) remove(session *Session) {
+	delete(s.byToken, session.token)
+	for secId := range session.sections {
+		delete(s.bySection[secId], session)
+		if len(s.bySection[secId]) == 0 {
+			delete(s.bySection, secId)
+		}
+	}
+	metrics.detachedSessions.Set(float64(len(s.byToken)))
+}
+
+// Periodically drops expired sessions. Returns once Shutdown is called.
+func (m *Manager) ExpireSessions() {
+	ticker := time.NewTicker(m.config.Websocket.ResumeWindow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stopEvents:
+			return
+		case now := <-ticker.C:
+			m.sessions.Expire(now)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDroppingSessionsDoesNotWaitForRelease(t *testing.T) {
+	blocked := make(chan struct{})
+	released := make(chan []string, 1)
+	sessions := NewSessions(time.Minute, 1, func(sections ...string) {
+		<-blocked
+		released <- sections
+	})
+	sessions.Detach("token", map[string]struct{}{"0": {}}, nil, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// The second event overflows the buffer and drops the session
+		sessions.Buffer("0", []byte("a"))
+		sessions.Buffer("0", []byte("b"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("buffering waited for the sections to be released")
+	}
+	if _, ok := sessions.Resume("token"); ok {
+		t.Error("overflowed session can still be resumed")
+	}
+
+	close(blocked)
+	if got := <-released; len(got) != 1 || got[0] != "0" {
+		t.Errorf("released %v, want [0]", got)
+	}
+}
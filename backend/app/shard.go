@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-rendezvous"
+	"github.com/redis/go-redis/v9"
+)
+
+// Published on the metadata redis whenever the shard map changes
+const shardMapChannel = "shard_map"
+
+// Name of the shard used when no shards are configured (backed by the metadata redis)
+const defaultShardName = "default"
+
+// Decides which redis instance holds the pixel data of a section. By default a
+// section is placed via rendezvous hashing of its id; entries in the shard map
+// stored in the metadata redis take precedence (that's how sections are moved).
+type Shards struct {
+	sync.RWMutex
+	meta     *redis.Client
+	clients  map[string]*redis.Client
+	names    []string
+	ring     *rendezvous.Rendezvous
+	explicit map[string]string // secId -> shard name
+}
+
+func newRedisClient(addr string, password Secret, db int) *redis.Client {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: string(password),
+		DB:       db,
+	})
+	rdb.AddHook(redisMetricsHook{})
+	return rdb
+}
+
+func NewShards(meta *redis.Client, cfgs []RedisShardConfig) *Shards {
+	s := &Shards{
+		meta:     meta,
+		clients:  make(map[string]*redis.Client),
+		explicit: make(map[string]string),
+	}
+
+	if len(cfgs) == 0 {
+		s.clients[defaultShardName] = meta
+	}
+	for _, cfg := range cfgs {
+		s.clients[cfg.Name] = newRedisClient(cfg.Addr, cfg.Password, cfg.DB)
+	}
+
+	for name := range s.clients {
+		s.names = append(s.names, name)
+	}
+	sort.Strings(s.names)
+	s.ring = rendezvous.New(s.names, xxhash.Sum64String)
+
+	return s
+}
+
+// (Re)loads the explicit shard assignments from the metadata redis
+func (s *Shards) Load(ctx context.Context) error {
+	explicit, err := s.meta.HGetAll(ctx, REDIS_KEYS.SHARD_MAP).Result()
+	if err != nil {
+		return err
+	}
+	for secId, name := range explicit {
+		if _, ok := s.clients[name]; !ok {
+			return fmt.Errorf("section %s is assigned to unknown shard %s", secId, name)
+		}
+	}
+
+	s.Lock()
+	s.explicit = explicit
+	s.Unlock()
+
+	slog.Info("loaded shard map", "shards", len(s.names), "explicit", len(explicit))
+	return nil
+}
+
+// Name of the shard holding the section's data
+func (s *Shards) Name(secId string) string {
+	s.RLock()
+	defer s.RUnlock()
+
+	if name, ok := s.explicit[secId]; ok {
+		return name
+	}
+	return s.ring.Lookup(secId)
+}
+
+// Client of the shard holding the section's data
+func (s *Shards) For(secId string) *redis.Client {
+	return s.clients[s.Name(secId)]
+}
+
+func (s *Shards) Client(name string) (*redis.Client, bool) {
+	client, ok := s.clients[name]
+	return client, ok
+}
+
+// All shards by name
+func (s *Shards) All() map[string]*redis.Client {
+	return s.clients
+}
+
+func (s *Shards) Close() error {
+	var firstErr error
+	for _, client := range s.clients {
+		if client == s.meta {
+			continue
+		}
+		if err := client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Moves the pixel data of a section to another shard while the servers keep running.
+// The state of the move is kept next to the section's data on the current shard, so
+// that every write sees it no matter how current the server's shard map is (see
+// SetPixel):
+//
+//  1. The section is marked as migrating. Writes to the section are logged.
+//  2. The data is copied to the target shard and the logged writes are replayed on it.
+//  3. The section is fenced, writes fail until the servers know about the new shard.
+//     The remaining logged writes are replayed, so the target has the same data.
+//  4. The shard map is flipped to the target shard and the servers retry their
+//     writes there. The data on the old shard is removed, the fence stays behind for
+//     servers which still haven't picked up the new shard map.
+func moveSection(ctx context.Context, cfg *Config, secId, target string) (err error) {
+	meta := newRedisClient(cfg.Redis.Addr, cfg.Redis.Password, cfg.Redis.DB)
+	defer meta.Close()
+	shards := NewShards(meta, cfg.Redis.Shards)
+	defer shards.Close()
+
+	if err := shards.Load(ctx); err != nil {
+		return err
+	}
+	if isMember, err := meta.SIsMember(ctx, REDIS_KEYS.SEC_IDS, secId).Result(); err != nil {
+		return err
+	} else if !isMember {
+		return fmt.Errorf("unknown section %s", secId)
+	}
+	bitsPerColor, err := meta.Get(ctx, REDIS_KEYS.BITS_PER_COLOR).Int()
+	if err != nil {
+		return fmt.Errorf("could not get bits per color: %w", err)
+	}
+
+	sourceName := shards.Name(secId)
+	if sourceName == target {
+		slog.Info("section already lives on target shard", "secId", secId, "shard", target)
+		return nil
+	}
+	source := shards.For(secId)
+	dest, ok := shards.Client(target)
+	if !ok {
+		return fmt.Errorf("unknown shard %s", target)
+	}
+	key, stateKey, logKey := REDIS_KEYS.SEC_PIX_DATA(secId), REDIS_KEYS.MIGRATION_STATE(secId), REDIS_KEYS.MIGRATION_LOG(secId)
+	if exists, err := dest.Exists(ctx, key).Result(); err != nil {
+		return err
+	} else if exists != 0 {
+		return fmt.Errorf("shard %s already contains data for section %s", target, secId)
+	}
+	// Left behind if the section has been moved away from the target before
+	if err := dest.Del(ctx, stateKey, logKey).Err(); err != nil {
+		return err
+	}
+
+	logger := slog.With("secId", secId, "from", sourceName, "to", target)
+
+	// 1. Start logging writes
+	logger.Info("marking section as migrating")
+	if started, err := source.SetNX(ctx, stateKey, "logging", 0).Result(); err != nil {
+		return err
+	} else if !started {
+		return fmt.Errorf("section %s is already being moved", secId)
+	}
+	switched := false
+	defer func() {
+		if err == nil || switched {
+			return
+		}
+		// Abort: the section stays where it is
+		logger.Warn("aborting move", "err", err)
+		source.Del(ctx, stateKey, logKey)
+		dest.Del(ctx, key)
+	}()
+
+	// 2. Copy the data and catch up with the writes made in the meantime
+	data, err := source.Get(ctx, key).Bytes()
+	if err != nil {
+		return fmt.Errorf("could not read section data: %w", err)
+	}
+	if err := dest.Set(ctx, key, data, 0).Err(); err != nil {
+		return fmt.Errorf("could not write section data: %w", err)
+	}
+	logger.Info("copied section data", "bytes", len(data))
+	replayed, err := replayMigrationLog(ctx, source, dest, secId, bitsPerColor)
+	if err != nil {
+		return err
+	}
+	logger.Info("replayed logged writes", "writes", replayed)
+
+	// 3. Stop the writes and catch up with the last ones
+	if err := source.Set(ctx, stateKey, "fenced", 0).Err(); err != nil {
+		return err
+	}
+	replayed, err = replayMigrationLog(ctx, source, dest, secId, bitsPerColor)
+	if err != nil {
+		return err
+	}
+	logger.Info("fenced section, replayed remaining writes", "writes", replayed)
+
+	// 4. Switch over
+	if err := meta.HSet(ctx, REDIS_KEYS.SHARD_MAP, secId, target).Err(); err != nil {
+		return err
+	}
+	switched = true
+	if err := meta.Publish(ctx, shardMapChannel, secId).Err(); err != nil {
+		// Servers reload the shard map once their writes hit the fence
+		logger.Warn("could not announce new shard map", "err", err)
+	}
+	if err := source.Del(ctx, key, logKey).Err(); err != nil {
+		return fmt.Errorf("could not remove section data from old shard: %w", err)
+	}
+	logger.Info("moved section")
+	return nil
+}
+
+// Applies the writes logged on the source shard to the destination shard
+func replayMigrationLog(ctx context.Context, source, dest *redis.Client, secId string, bitsPerColor int) (int, error) {
+	t := fmt.Sprintf("u%d", bitsPerColor)
+	replayed := 0
+	for {
+		entries, err := source.LPopCount(ctx, REDIS_KEYS.MIGRATION_LOG(secId), 1000).Result()
+		if errors.Is(err, redis.Nil) || (err == nil && len(entries) == 0) {
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		pipe := dest.Pipeline()
+		for _, entry := range entries {
+			var setPixData SetPixelData
+			if err := json.Unmarshal([]byte(entry), &setPixData); err != nil {
+				return replayed, fmt.Errorf("invalid migration log entry %q: %w", entry, err)
+			}
+			pipe.BitField(ctx, REDIS_KEYS.SEC_PIX_DATA(secId), "set", t, fmt.Sprintf("#%d", setPixData.PixIdx), setPixData.ColorId)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return replayed, err
+		}
+		replayed += len(entries)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reason sent along with the close frame so that clients know to reconnect
+const reconnectCloseReason = "reconnect"
+
+func closeWithReconnect(conn *websocket.Conn, writeWait time.Duration) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseServiceRestart, reconnectCloseReason)
+	return conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+}
+
+// Waits for the WaitGroup to finish or the context to expire, whichever comes first
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Registers an admin job which Shutdown will wait for. Returns false if the
+// manager is already shutting down, in which case no job must be started.
+func (m *Manager) beginJob() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.shuttingDown {
+		return false
+	}
+	m.jobs.Add(1)
+	return true
+}
+
+func (m *Manager) endJob() {
+	m.jobs.Done()
+}
+
+// Wraps an admin handler (loading images, changing the palette, ...) so that
+// Shutdown waits for it and it isn't started anymore once the manager shuts down
+func adminJob(handler func(w http.ResponseWriter, r *http.Request, m *Manager)) func(w http.ResponseWriter, r *http.Request, m *Manager) {
+	return func(w http.ResponseWriter, r *http.Request, m *Manager) {
+		if !m.beginJob() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, ErrShuttingDown)
+			return
+		}
+		defer m.endJob()
+		handler(w, r, m)
+	}
+}
+
+// Stops accepting new websocket connections and admin jobs, tells every connected
+// client to reconnect, processes the client requests which are still queued and
+// waits for in-flight admin jobs. The connection to redis stays open (see Close),
+// since http handlers might still be using it.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.Lock()
+	if m.shuttingDown {
+		m.Unlock()
+		return nil
+	}
+	m.shuttingDown = true
+	eventsRunning := m.eventsRunning
+	clients := make([]*Client, 0, len(m.clients))
+	for client := range m.clients {
+		clients = append(clients, client)
+	}
+	m.Unlock()
+
+	slog.Info("shutting down manager", "clients", len(clients))
+
+	// Stop fanning out events so that nothing gets written to clients we're about to remove.
+	// This also stops MonitorStore.
+	close(m.stopEvents)
+	if eventsRunning {
+		select {
+		case <-m.eventsStopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// The workers keep routing requests sent by clients before they received the close frame
+	for _, client := range clients {
+		if err := closeWithReconnect(client.connection, m.config.Websocket.WriteWait); err != nil {
+			client.logger.Debug("could not send close frame", "err", err)
+		}
+		m.removeClient(client)
+	}
+
+	if err := waitContext(ctx, &m.readers); err != nil {
+		return err
+	}
+	select {
+	case <-m.requests.stop():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	slog.Info("drained client requests")
+
+	if err := waitContext(ctx, &m.jobs); err != nil {
+		return err
+	}
+	slog.Info("finished admin jobs")
+
+	return nil
+}
+
+// Closes the connection to the store
+func (m *Manager) Close() error {
+	return m.store.Close()
+}
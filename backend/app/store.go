@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrUserNotFound   = errors.New("user does not exist")
+	ErrUserExists     = errors.New("user already exists")
+	ErrTokenUnknown   = errors.New("unknown or expired token")
+	ErrAPIKeyNotFound = errors.New("api key does not exist")
+	ErrStoreInUse     = errors.New("data directory is used by another process")
+)
+
+// Everything the manager persists or shares with the other replicas. Pixel data
+// is packed with bitsPerColor bits per pixel, most significant bit first (the
+// layout of redis' BITFIELD, see IterateSectionData).
+type CanvasStore interface {
+	// Prepares the store for use once it is reachable (e.g. loads the shard map)
+	Open(ctx context.Context) error
+	Ping(ctx context.Context) error
+	// Wipes the whole canvas. User accounts are kept.
+	Reset(ctx context.Context) error
+	Close() error
+
+	SectionsMeta(ctx context.Context) ([]SectionMetaData, error)
+	SaveSectionsMeta(ctx context.Context, sections []SectionMetaData) error
+	SectionData(ctx context.Context, secId string) ([]byte, error)
+	SaveSectionData(ctx context.Context, secId string, data []byte) error
+	SetPixel(ctx context.Context, bitsPerColor int, setPixData SetPixelData) error
+	CountSectionServed(ctx context.Context, secId string) error
+
+	Palette(ctx context.Context) (bitsPerColor int, colors []ColorChoice, err error)
+	SavePalette(ctx context.Context, bitsPerColor int, colors []ColorChoice) error
+
+	Positions(ctx context.Context) (map[string]PositionInfo, error)
+	SavePosition(ctx context.Context, posId string, pos PositionInfo) error
+	DeletePosition(ctx context.Context, posId string) error
+
+	User(ctx context.Context, username string) (User, error)
+	SaveUser(ctx context.Context, user User) error
+	// Like SaveUser, but fails with ErrUserExists instead of overwriting a user
+	CreateUser(ctx context.Context, user User) error
+
+	// Refresh tokens are kept by the hash of their value and can be taken (used) only once
+	SaveRefreshToken(ctx context.Context, id string, token RefreshToken) error
+	// Returns ErrTokenUnknown if the token doesn't exist or has expired
+	TakeRefreshToken(ctx context.Context, id string) (RefreshToken, error)
+	// Denylist of access tokens (by jti), entries are dropped once the token expires anyway
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	TokenRevoked(ctx context.Context, jti string) (bool, error)
+
+	// API keys are kept by their id, along with the hash of their value
+	SaveAPIKey(ctx context.Context, key APIKey) error
+	APIKey(ctx context.Context, id string) (APIKey, error)
+	APIKeys(ctx context.Context) ([]APIKey, error)
+	// Returns ErrAPIKeyNotFound if there is no such key
+	DeleteAPIKey(ctx context.Context, id string) error
+
+	// Pixels published by any replica are delivered on Pixels() for the sections
+	// which are subscribed to
+	PublishPixel(ctx context.Context, setPixData SetPixelData) error
+	SubscribeSection(ctx context.Context, secId string) error
+	UnsubscribeSection(ctx context.Context, secId string) error
+	Pixels() <-chan SetPixelData
+	// (Re)subscribes after the connection dropped; reports whether all subscriptions are active
+	EnsureSubscribed(ctx context.Context) bool
+	Subscribed() bool
+}
+
+// Implemented by the local stores, which can be seeded with a fresh canvas on their first start
+type emptyChecker interface {
+	Empty() bool
+}
+
+func NewStore(cfg *Config) (CanvasStore, error) {
+	switch cfg.Store {
+	case "redis":
+		return NewRedisStore(cfg), nil
+	case "disk":
+		return NewDiskStore(cfg.Disk)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
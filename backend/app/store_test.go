@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// The stores which don't need any external services
+func localStores(t *testing.T) map[string]CanvasStore {
+	t.Helper()
+	stores := map[string]CanvasStore{"memory": NewMemoryStore()}
+	disk, err := NewDiskStore(DiskConfig{Dir: t.TempDir(), SyncInterval: 10 * time.Millisecond, CheckpointInterval: time.Hour})
+	if err == nil {
+		stores["disk"] = disk
+		t.Cleanup(func() { disk.Close() })
+	} else {
+		t.Logf("skipping disk store: %v", err)
+	}
+	return stores
+}
+
+func TestStorePixels(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range localStores(t) {
+		t.Run(name, func(t *testing.T) {
+			const bits, w, h = 5, 4, 3
+			store.SaveSectionsMeta(ctx, []SectionMetaData{{Point{0, 0}, Point{w, h}, "s"}})
+			store.SavePalette(ctx, bits, []ColorChoice{{0, 0, []int{0, 0, 0}}})
+			if err := store.SaveSectionData(ctx, "s", make([]byte, (w*h*bits+7)/8)); err != nil {
+				t.Fatal(err)
+			}
+
+			want := make([]int, w*h)
+			for i, color := range []int{31, 0, 17, 1, 30} {
+				idx := i * 2
+				want[idx] = color
+				if err := store.SetPixel(ctx, bits, SetPixelData{"s", idx, color}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, err := store.SectionData(ctx, "s")
+			if err != nil {
+				t.Fatal(err)
+			}
+			idx := 0
+			for color := range IterateSectionData(data, w*h*bits, bits) {
+				if color != want[idx] {
+					t.Errorf("pixel %d: got %d, want %d", idx, color, want[idx])
+				}
+				idx++
+			}
+		})
+	}
+}
+
+func TestStoreMetadata(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range localStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := store.User(ctx, "nobody"); !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("got %v for unknown user, want ErrUserNotFound", err)
+			}
+			if err := store.CreateUser(ctx, User{Username: "admin", PasswordHash: "hash"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.CreateUser(ctx, User{Username: "admin"}); !errors.Is(err, ErrUserExists) {
+				t.Errorf("got %v for existing user, want ErrUserExists", err)
+			}
+			store.SaveUser(ctx, User{Username: "admin", PasswordHash: "new hash"})
+			if user, err := store.User(ctx, "admin"); err != nil || user.PasswordHash != "new hash" || user.Password != "" {
+				t.Errorf("got %+v, %v", user, err)
+			}
+
+			pos := PositionInfo{Point{1, 2}, PositionImageInfo{Point{0, 0}, 2, 4}}
+			store.SavePosition(ctx, "p", pos)
+			if positions, _ := store.Positions(ctx); positions["p"] != pos {
+				t.Errorf("got positions %+v", positions)
+			}
+			store.DeletePosition(ctx, "p")
+			if positions, _ := store.Positions(ctx); len(positions) != 0 {
+				t.Errorf("position not deleted: %+v", positions)
+			}
+
+			if err := store.Reset(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.User(ctx, "admin"); err != nil {
+				t.Errorf("user is gone after reset: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreTokens(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range localStores(t) {
+		t.Run(name, func(t *testing.T) {
+			token := RefreshToken{Username: "admin", ExpiresAt: time.Now().Add(time.Hour)}
+			store.SaveRefreshToken(ctx, "live", token)
+			store.SaveRefreshToken(ctx, "expired", RefreshToken{Username: "admin", ExpiresAt: time.Now().Add(-time.Second)})
+			if got, err := store.TakeRefreshToken(ctx, "live"); err != nil || got.Username != token.Username {
+				t.Errorf("got %+v, %v", got, err)
+			}
+			for _, id := range []string{"live", "expired", "unknown"} {
+				if _, err := store.TakeRefreshToken(ctx, id); !errors.Is(err, ErrTokenUnknown) {
+					t.Errorf("%s: got %v, want ErrTokenUnknown", id, err)
+				}
+			}
+
+			store.RevokeToken(ctx, "jti", time.Now().Add(time.Hour))
+			if revoked, err := store.TokenRevoked(ctx, "jti"); !revoked || err != nil {
+				t.Errorf("got %v, %v for revoked token", revoked, err)
+			}
+			if revoked, _ := store.TokenRevoked(ctx, "other"); revoked {
+				t.Error("token which wasn't revoked counts as revoked")
+			}
+		})
+	}
+}
+
+func TestDiskStoreLocksItsDirectory(t *testing.T) {
+	cfg := DiskConfig{Dir: t.TempDir(), SyncInterval: time.Second, CheckpointInterval: time.Hour}
+	first, err := NewDiskStore(cfg)
+	if err != nil {
+		t.Skipf("disk store unavailable: %v", err)
+	}
+	if _, err := NewDiskStore(cfg); !errors.Is(err, ErrStoreInUse) {
+		t.Fatalf("opening a directory in use: got %v, want %v", err, ErrStoreInUse)
+	}
+	first.Close()
+
+	second, err := NewDiskStore(cfg)
+	if err != nil {
+		t.Fatalf("could not open the directory after it was released: %v", err)
+	}
+	second.Close()
+}
+
+func TestWalStopsAtTornRecord(t *testing.T) {
+	var buf []byte
+	buf = appendWalRecord(buf, walRecord{SetPixelData{"12", 1_000_000, 63}, 6})
+	buf = appendWalRecord(buf, walRecord{SetPixelData{"7", 0, 1}, 6})
+	full := len(buf)
+	buf = appendWalRecord(buf, walRecord{SetPixelData{"7", 1, 2}, 6})
+
+	records, err := readWalRecords(bytes.NewReader(buf[:full]))
+	if err != nil || len(records) != 2 || records[0].SetPixelData != (SetPixelData{"12", 1_000_000, 63}) {
+		t.Fatalf("got %+v, %v", records, err)
+	}
+
+	records, err = readWalRecords(bytes.NewReader(buf[:len(buf)-1]))
+	if !errors.Is(err, errTornWal) || len(records) != 2 {
+		t.Fatalf("got %d records, %v for torn log", len(records), err)
+	}
+
+	buf[full+10] ^= 0xff
+	if records, err = readWalRecords(bytes.NewReader(buf)); !errors.Is(err, errTornWal) || len(records) != 2 {
+		t.Fatalf("got %d records, %v for corrupt log", len(records), err)
+	}
+}
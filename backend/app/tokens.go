@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Server side state of a refresh token. Its value is only known to the client.
+type RefreshToken struct {
+	Username string `json:"username"`
+	// Of the login the token descends from, rotation keeps it
+	ExpiresAt time.Time `json:"expiresAt"`
+	// The user's token generation at the time of the login, see User
+	Generation int `json:"generation,omitempty"`
+}
+
+func (t RefreshToken) expired() bool {
+	return time.Now().After(t.ExpiresAt)
+}
+
+// What a client gets after logging in or refreshing
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	// Seconds until the access token expires
+	ExpiresIn int `json:"expiresIn"`
+}
+
+// Returns a new refresh token value and the id it is stored under
+func newRefreshTokenValue() (value, id string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	value = base64.RawURLEncoding.EncodeToString(b)
+	return value, hashToken(value), nil
+}
+
+// Only hashes of refresh tokens and API keys are stored, a leaked store doesn't
+// leak usable credentials
+func hashToken(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates an access token and a refresh token valid until expiresAt
+func (m *Manager) issueTokens(user User, expiresAt time.Time) (TokenPair, error) {
+	accessToken, err := createToken(m.config, user)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	value, id, err := newRefreshTokenValue()
+	if err != nil {
+		return TokenPair{}, err
+	}
+	if err := m.store.SaveRefreshToken(*m.ctx, id, RefreshToken{user.Username, expiresAt, user.TokenGeneration}); err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{accessToken, value, "Bearer", int(m.config.Auth.AccessTokenTTL.Seconds())}, nil
+}
+
+func writeTokens(w http.ResponseWriter, tokens TokenPair) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Swaps a refresh token for a new pair of tokens. The old refresh token can't be used again.
+func RefreshHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	w.Header().Set("Content-Type", "text/plain")
+	logger := loggerFrom(r.Context())
+
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		countError("RefreshHandler", "decode")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Invalid request")
+		return
+	}
+
+	refreshToken, err := m.store.TakeRefreshToken(*m.ctx, hashToken(req.RefreshToken))
+	if err != nil {
+		if errors.Is(err, ErrTokenUnknown) {
+			countError("RefreshHandler", "unknown_token")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "Invalid refresh token")
+			return
+		}
+		logger.Error("could not load refresh token", "err", err)
+		countError("RefreshHandler", "load_token")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Picks up role changes, deleted users can't refresh
+	user, err := m.LoadUser(refreshToken.Username)
+	if err != nil {
+		logger.Warn("could not load user of refresh token", "username", refreshToken.Username, "err", err)
+		countError("RefreshHandler", "load_user")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Invalid refresh token")
+		return
+	}
+	if refreshToken.Generation != user.TokenGeneration {
+		logger.Info("refresh token predates password change", "user", user)
+		countError("RefreshHandler", "password_changed")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, "Invalid refresh token")
+		return
+	}
+	tokens, err := m.issueTokens(user, refreshToken.ExpiresAt)
+	if err != nil {
+		logger.Error("could not issue tokens", "err", err)
+		countError("RefreshHandler", "issue")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, tokens)
+}
+
+// Revokes the access token the request was made with and, if given, the refresh token
+func LogoutHandler(w http.ResponseWriter, r *http.Request, m *Manager) {
+	logger := loggerFrom(r.Context())
+	claims, ok := claimsFrom(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "API keys are revoked by an admin")
+		return
+	}
+
+	var req RefreshRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			countError("LogoutHandler", "decode")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Invalid request")
+			return
+		}
+	}
+
+	if err := m.store.RevokeToken(*m.ctx, claims.ID, claims.ExpiresAt.Time); err != nil {
+		logger.Error("could not revoke access token", "err", err)
+		countError("LogoutHandler", "revoke")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if req.RefreshToken != "" {
+		_, err := m.store.TakeRefreshToken(*m.ctx, hashToken(req.RefreshToken))
+		if err != nil && !errors.Is(err, ErrTokenUnknown) {
+			logger.Error("could not revoke refresh token", "err", err)
+			countError("LogoutHandler", "revoke_refresh")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+	logger.Info("logged out", "username", claims.Username)
+}
+
+func withClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsContextKey, claims)
+}
+
+// The claims of the token an authorized request was made with
+func claimsFrom(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+// Refresh tokens, revoked access tokens and API keys of the stores which keep them in memory
+type tokenLists struct {
+	RefreshTokens map[string]RefreshToken `json:"refreshTokens"`
+	RevokedTokens map[string]time.Time    `json:"revokedTokens"`
+	APIKeys       map[string]APIKey       `json:"apiKeys"`
+}
+
+func newTokenLists() tokenLists {
+	return tokenLists{make(map[string]RefreshToken), make(map[string]time.Time), make(map[string]APIKey)}
+}
+
+func (l *tokenLists) saveRefresh(id string, token RefreshToken) {
+	l.prune()
+	l.RefreshTokens[id] = token
+}
+
+func (l *tokenLists) takeRefresh(id string) (RefreshToken, error) {
+	token, ok := l.RefreshTokens[id]
+	if !ok || token.expired() {
+		return RefreshToken{}, ErrTokenUnknown
+	}
+	delete(l.RefreshTokens, id)
+	return token, nil
+}
+
+func (l *tokenLists) revoke(jti string, expiresAt time.Time) {
+	l.prune()
+	l.RevokedTokens[jti] = expiresAt
+}
+
+func (l *tokenLists) revoked(jti string) bool {
+	_, ok := l.RevokedTokens[jti]
+	return ok
+}
+
+func (l *tokenLists) apiKey(id string) (APIKey, error) {
+	key, ok := l.APIKeys[id]
+	if !ok {
+		return APIKey{}, fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	key.Scopes = slices.Clone(key.Scopes)
+	return key, nil
+}
+
+func (l *tokenLists) apiKeyList() []APIKey {
+	keys := make([]APIKey, 0, len(l.APIKeys))
+	for id := range l.APIKeys {
+		key, _ := l.apiKey(id)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (l *tokenLists) deleteAPIKey(id string) error {
+	if _, ok := l.APIKeys[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	delete(l.APIKeys, id)
+	return nil
+}
+
+func (l *tokenLists) prune() {
+	now := time.Now()
+	for id, token := range l.RefreshTokens {
+		if now.After(token.ExpiresAt) {
+			delete(l.RefreshTokens, id)
+		}
+	}
+	for jti, expiresAt := range l.RevokedTokens {
+		if now.After(expiresAt) {
+			delete(l.RevokedTokens, jti)
+		}
+	}
+}
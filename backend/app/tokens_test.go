@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	srv := newTestServer(t)
+	srv.login(t, "mod", RolePainter)
+	first := srv.tokens(t, "mod", "password of mod")
+
+	// Role changes apply once the token is refreshed
+	admin := srv.login(t, "admin", RoleAdmin)
+	srv.post(t, "/user-role", admin, RoleChange{"mod", "moderator"})
+
+	status, body := srv.post(t, "/refresh", "", RefreshRequest{first.RefreshToken})
+	if status != http.StatusOK {
+		t.Fatalf("refresh: got %d %q", status, body)
+	}
+	var second TokenPair
+	json.Unmarshal([]byte(body), &second)
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+		t.Fatalf("tokens weren't rotated: %+v", second)
+	}
+	if status, _ := srv.post(t, "/delete-pos-id?pos=unknown", second.AccessToken, nil); status != http.StatusOK {
+		t.Errorf("refreshed token lacks the new role: got %d", status)
+	}
+
+	if status, _ := srv.post(t, "/refresh", "", RefreshRequest{first.RefreshToken}); status != http.StatusUnauthorized {
+		t.Errorf("reusing a refresh token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestLogoutRevokesTokens(t *testing.T) {
+	srv := newTestServer(t)
+	srv.login(t, "admin", RoleAdmin)
+	tokens := srv.tokens(t, "admin", "password of admin")
+
+	if status, _ := srv.post(t, "/logout", tokens.AccessToken, RefreshRequest{tokens.RefreshToken}); status != http.StatusOK {
+		t.Fatalf("logout: got %d", status)
+	}
+	if status, _ := srv.post(t, "/delete-pos-id?pos=unknown", tokens.AccessToken, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked access token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := srv.post(t, "/refresh", "", RefreshRequest{tokens.RefreshToken}); status != http.StatusUnauthorized {
+		t.Errorf("revoked refresh token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestRejectsForeignTokens(t *testing.T) {
+	cfg := testConfig()
+	valid := Claims{
+		Username: "admin",
+		Role:     RoleAdmin,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        newId(),
+			Issuer:    cfg.Auth.Issuer,
+			Audience:  jwt.ClaimStrings{cfg.Auth.Audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	sign := func(method jwt.SigningMethod, key any, change func(c *Claims)) string {
+		claims := valid
+		change(&claims)
+		s, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	secret := []byte(cfg.JWTSecret)
+
+	if _, err := verifyToken(cfg, sign(jwt.SigningMethodHS256, secret, func(*Claims) {})); err != nil {
+		t.Fatalf("valid token was rejected: %v", err)
+	}
+	for name, token := range map[string]string{
+		"none algorithm": sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, func(*Claims) {}),
+		"other hmac":     sign(jwt.SigningMethodHS512, secret, func(*Claims) {}),
+		"wrong secret":   sign(jwt.SigningMethodHS256, []byte("guessed"), func(*Claims) {}),
+		"wrong issuer":   sign(jwt.SigningMethodHS256, secret, func(c *Claims) { c.Issuer = "someone" }),
+		"wrong audience": sign(jwt.SigningMethodHS256, secret, func(c *Claims) { c.Audience = jwt.ClaimStrings{"other"} }),
+		"no expiry":      sign(jwt.SigningMethodHS256, secret, func(c *Claims) { c.ExpiresAt = nil }),
+		"no id":          sign(jwt.SigningMethodHS256, secret, func(c *Claims) { c.ID = "" }),
+	} {
+		if _, err := verifyToken(cfg, token); err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestMalformedAuthorizationHeader(t *testing.T) {
+	srv := newTestServer(t)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/delete-pos-id", nil)
+	req.Header.Set("Authorization", "Bear")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("got %d, want %d", res.StatusCode, http.StatusUnauthorized)
+	}
+}
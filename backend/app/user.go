@@ -1,6 +1,29 @@
 package main
 
+import "log/slog"
+
 type User struct {
-	Username string `json:"username" redis:"username"`
-	Password string `json:"password" redis:"password"`
+	Username     string `json:"username" redis:"username"`
+	PasswordHash string `json:"passwordHash,omitempty" redis:"passwordHash"`
+	// Plaintext password of accounts created before passwords were hashed,
+	// replaced by PasswordHash on their next login
+	Password Secret `json:"password,omitempty" redis:"password"`
+	Role     Role   `json:"role,omitempty" redis:"role"`
+	// Refresh tokens issued before the last password change carry an older generation
+	TokenGeneration int `json:"tokenGeneration,omitempty" redis:"tokenGeneration"`
+}
+
+// Only the username and role ever make it into the logs
+func (u User) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("username", u.Username), slog.String("role", string(u.Role)))
+}
+
+// What clients send to log in or register
+type Credentials struct {
+	Username string `json:"username"`
+	Password Secret `json:"password"`
+}
+
+func (c Credentials) LogValue() slog.Value {
+	return slog.GroupValue(slog.String("username", c.Username))
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// A pixel write as recorded in the write-ahead log of the disk store
+type walRecord struct {
+	SetPixelData
+	Bits int
+}
+
+// Record layout (little endian):
+//
+//	crc32 (4) | payload length (2) | bits (1) | pixIdx (4) | colorId (4) | secId
+const walHeaderSize = 4 + 2
+const walFixedPayloadSize = 1 + 4 + 4
+
+func appendWalRecord(buf []byte, rec walRecord) []byte {
+	payload := make([]byte, walFixedPayloadSize, walFixedPayloadSize+len(rec.SecId))
+	payload[0] = byte(rec.Bits)
+	binary.LittleEndian.PutUint32(payload[1:], uint32(rec.PixIdx))
+	binary.LittleEndian.PutUint32(payload[5:], uint32(rec.ColorId))
+	payload = append(payload, rec.SecId...)
+
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(len(payload)))
+	return append(buf, payload...)
+}
+
+// Reads records until the end of the log. A torn or corrupt record (left behind
+// by a crash in the middle of a write) ends the log; the records before it are
+// returned along with errTornWal.
+func readWalRecords(r io.Reader) ([]walRecord, error) {
+	var records []walRecord
+	br := bufio.NewReader(r)
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return records, errTornWal
+		}
+		sum := binary.LittleEndian.Uint32(header)
+		payload := make([]byte, binary.LittleEndian.Uint16(header[4:]))
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return records, errTornWal
+		}
+		if len(payload) < walFixedPayloadSize || crc32.ChecksumIEEE(payload) != sum {
+			return records, errTornWal
+		}
+
+		records = append(records, walRecord{
+			SetPixelData: SetPixelData{
+				SecId:   string(payload[walFixedPayloadSize:]),
+				PixIdx:  int(binary.LittleEndian.Uint32(payload[1:])),
+				ColorId: int(binary.LittleEndian.Uint32(payload[5:])),
+			},
+			Bits: int(payload[0]),
+		})
+	}
+}
+
+var errTornWal = errors.New("write-ahead log ends in a torn record")
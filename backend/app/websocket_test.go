@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestPixelIsFannedOutToSubscribers(t *testing.T) {
+	srv := newTestServer(t)
+	a, b, other := srv.dial(t, ""), srv.dial(t, ""), srv.dial(t, "")
+	a.subscribe("0")
+	b.subscribe("0", "1")
+	other.subscribe("1")
+	waitFor(t, "subscriptions", func() bool { return srv.subscribers("0") == 2 && srv.subscribers("1") == 2 })
+
+	pixel := SetPixelData{SecId: "0", PixIdx: 1234, ColorId: 7}
+	a.setPixel(pixel)
+	a.expectPixel(pixel)
+	b.expectPixel(pixel)
+	other.expectSilence()
+
+	if got := srv.sectionColors(t, "0")[pixel.PixIdx]; got != pixel.ColorId {
+		t.Errorf("section data has color %d at %d, want %d", got, pixel.PixIdx, pixel.ColorId)
+	}
+}
+
+func TestSectionDataReflectsWrites(t *testing.T) {
+	srv := newTestServer(t)
+	c := srv.dial(t, "")
+	c.subscribe("3")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("3") == 1 })
+
+	// Neighbouring pixels share bytes with 6 bits per color
+	pixels := []SetPixelData{{"3", 0, 31}, {"3", 1, 1}, {"3", 2, 26}, {"3", 999_999, 5}, {"3", 1, 2}}
+	for _, pixel := range pixels {
+		c.setPixel(pixel)
+		c.expectPixel(pixel)
+	}
+
+	colors := srv.sectionColors(t, "3")
+	want := map[int]int{0: 31, 1: 2, 2: 26, 3: 0, 999_999: 5}
+	for idx, color := range want {
+		if colors[idx] != color {
+			t.Errorf("pixel %d: got color %d, want %d", idx, colors[idx], color)
+		}
+	}
+}
+
+func TestUnsubscribedClientReceivesNothing(t *testing.T) {
+	srv := newTestServer(t)
+	a, b := srv.dial(t, ""), srv.dial(t, "")
+	a.subscribe("0")
+	b.subscribe("0")
+	waitFor(t, "subscriptions", func() bool { return srv.subscribers("0") == 2 })
+
+	a.unsubscribe("0")
+	waitFor(t, "unsubscription", func() bool { return srv.subscribers("0") == 1 })
+
+	pixel := SetPixelData{SecId: "0", PixIdx: 1, ColorId: 1}
+	b.setPixel(pixel)
+	b.expectPixel(pixel)
+	a.expectSilence()
+}
+
+func TestDisconnectRemovesClient(t *testing.T) {
+	srv := newTestServer(t)
+	gone, stays := srv.dial(t, ""), srv.dial(t, "")
+	gone.subscribe("0", "1")
+	stays.subscribe("0")
+	waitFor(t, "subscriptions", func() bool { return srv.subscribers("0") == 2 && srv.subscribers("1") == 1 })
+
+	gone.conn.Close()
+	waitFor(t, "client removal", func() bool { return srv.clientCount() == 1 })
+	if n := srv.subscribers("0"); n != 1 {
+		t.Errorf("section 0 has %d subscribers after disconnect, want 1", n)
+	}
+	if n := srv.subscribers("1"); n != 0 {
+		t.Errorf("section 1 has %d subscribers after disconnect, want 0", n)
+	}
+
+	// Fan-out to the remaining client keeps working
+	pixel := SetPixelData{SecId: "0", PixIdx: 5, ColorId: 3}
+	stays.setPixel(pixel)
+	stays.expectPixel(pixel)
+}
+
+func TestReconnectResumesSession(t *testing.T) {
+	srv := newTestServer(t)
+	first := srv.dial(t, "")
+	if first.session.Resumed {
+		t.Fatal("fresh connection claims to have resumed a session")
+	}
+	first.subscribe("2")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("2") == 1 })
+	first.conn.Close()
+	waitFor(t, "client removal", func() bool { return srv.clientCount() == 0 })
+
+	// Placed while the client is gone
+	other := srv.dial(t, "")
+	missed := SetPixelData{SecId: "2", PixIdx: 10, ColorId: 4}
+	other.setPixel(missed)
+	waitFor(t, "pixel to be written", func() bool { return srv.sectionColors(t, "2")[missed.PixIdx] == missed.ColorId })
+
+	resumed := srv.dial(t, first.session.Token)
+	if !resumed.session.Resumed || resumed.session.Missed != 1 {
+		t.Fatalf("got session %+v, want resumed with 1 missed event", resumed.session)
+	}
+	resumed.expectPixel(missed)
+	if n := srv.subscribers("2"); n != 1 {
+		t.Errorf("section 2 has %d subscribers after resuming, want 1", n)
+	}
+}
+
+func TestMalformedPixelIsRejected(t *testing.T) {
+	srv := newTestServer(t)
+	a, b := srv.dial(t, ""), srv.dial(t, "")
+	b.subscribe("0")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("0") == 1 })
+
+	for _, pixel := range []SetPixelData{
+		{SecId: "0", PixIdx: -2, ColorId: 1},
+		{SecId: "0", PixIdx: 1_000_000, ColorId: 1},
+		{SecId: "0", PixIdx: 1 << 40, ColorId: 1},
+		{SecId: "0", PixIdx: 1, ColorId: 1000},
+		{SecId: "nope", PixIdx: 1, ColorId: 1},
+	} {
+		a.setPixel(pixel)
+	}
+
+	// The server is still alive and none of the invalid pixels was sent on
+	pixel := SetPixelData{SecId: "0", PixIdx: 1, ColorId: 3}
+	a.setPixel(pixel)
+	b.expectPixel(pixel)
+	if colors := srv.sectionColors(t, "0"); len(colors) != 1_000_000 || colors[1] != 3 {
+		t.Errorf("section has %d pixels, pixel 1 has color %d", len(colors), colors[1])
+	}
+}
+
+func TestResumeWhilePixelsArePlacedMissesNothing(t *testing.T) {
+	srv := newTestServer(t)
+	first := srv.dial(t, "")
+	first.subscribe("2")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("2") == 1 })
+	first.conn.Close()
+	waitFor(t, "client removal", func() bool { return srv.clientCount() == 0 })
+
+	// Pixels keep coming in while the client resumes
+	const count = 200
+	painter := srv.dial(t, "")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range count {
+			if err := painter.conn.WriteJSON(SocketEvent{EventSetPixel, []byte(fmt.Sprintf(`{"secId":"2","pixIdx":%d,"colorId":1}`, i))}); err != nil {
+				return
+			}
+		}
+	}()
+	resumed := srv.dial(t, first.session.Token)
+	if !resumed.session.Resumed {
+		t.Fatal("session was not resumed")
+	}
+
+	// Missed and live pixels together are every pixel since the painter started
+	for want := 0; want < count; want++ {
+		evt := resumed.read()
+		var got SetPixelData
+		json.Unmarshal(evt.Data, &got)
+		if got.PixIdx != want {
+			t.Fatalf("got pixel %d, want %d", got.PixIdx, want)
+		}
+	}
+	<-done
+}
+
+func TestSlowClientResumesWithoutMissingPixels(t *testing.T) {
+	cfg := testConfig()
+	cfg.Websocket.ResumeBufferSize = 100_000
+	srv := newTestServerWithConfig(t, cfg)
+
+	// A client which doesn't read, with a small receive window so the server
+	// can't write ahead much
+	dialer := websocket.Dialer{NetDial: func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if err == nil {
+			conn.(*net.TCPConn).SetReadBuffer(4096)
+		}
+		return conn, err
+	}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	slow := &testClient{t: t, conn: conn}
+	json.Unmarshal(slow.read().Data, &slow.session)
+	slow.subscribe("4")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("4") == 1 })
+
+	sent := 0
+	for ; srv.clientCount() > 0; sent++ {
+		if sent == 1_000_000 {
+			t.Fatal("client was never disconnected")
+		}
+		srv.manager.fanOutPixel(SetPixelData{SecId: "4", PixIdx: sent, ColorId: 1})
+	}
+	// Some more while the client is away
+	for end := sent + 10; sent < end; sent++ {
+		srv.manager.fanOutPixel(SetPixelData{SecId: "4", PixIdx: sent, ColorId: 1})
+	}
+
+	// What made it onto the old connection, then what the session kept
+	next := 0
+	for {
+		evt, err := slow.tryRead(time.Second)
+		if err != nil {
+			break
+		}
+		var pixel SetPixelData
+		json.Unmarshal(evt.Data, &pixel)
+		if pixel.PixIdx != next {
+			t.Fatalf("old connection got pixel %d, want %d", pixel.PixIdx, next)
+		}
+		next++
+	}
+	resumed := srv.dial(t, slow.session.Token)
+	if !resumed.session.Resumed {
+		t.Fatal("session was not resumed")
+	}
+	for i := range resumed.session.Missed {
+		var pixel SetPixelData
+		json.Unmarshal(resumed.read().Data, &pixel)
+		// Pixels written just before the connection was closed may come again
+		if i == 0 && pixel.PixIdx < next {
+			next = pixel.PixIdx
+		}
+		if pixel.PixIdx != next {
+			t.Fatalf("missed pixel %d is %d, want %d", i, pixel.PixIdx, next)
+		}
+		next++
+	}
+	if next != sent {
+		t.Errorf("got pixels up to %d, %d were sent", next, sent)
+	}
+}
+
+func TestAnonymousRoleLimitsClientsWithoutToken(t *testing.T) {
+	cfg := testConfig()
+	cfg.Auth.AnonymousRole = RoleViewer
+	srv := newTestServerWithConfig(t, cfg)
+	painter := srv.dialQuery(t, "access_token="+srv.login(t, "painter", RolePainter))
+	painter.subscribe("0")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("0") == 1 })
+
+	// Requests of a client are handled in order, once it is subscribed its pixel has been dealt with
+	anonymous := srv.dial(t, "")
+	anonymous.setPixel(SetPixelData{SecId: "0", PixIdx: 1, ColorId: 1})
+	anonymous.subscribe("0")
+	waitFor(t, "subscription", func() bool { return srv.subscribers("0") == 2 })
+	if got := srv.sectionColors(t, "0")[1]; got != 0 {
+		t.Errorf("anonymous viewer set a pixel to %d", got)
+	}
+
+	pixel := SetPixelData{SecId: "0", PixIdx: 2, ColorId: 2}
+	painter.setPixel(pixel)
+	painter.expectPixel(pixel)
+	anonymous.expectPixel(pixel)
+}
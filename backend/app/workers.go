@@ -0,0 +1,69 @@
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Routes client requests on a fixed number of goroutines. All requests of a
+// client end up on the same worker, so they are handled in the order they were
+// sent. Once a worker's queue is full, submit blocks, which stops the client's
+// reader and pushes back on the client instead of piling up goroutines.
+type workerPool struct {
+	queues  []chan ClientRequest
+	handle  func(ClientRequest)
+	queued  atomic.Int64
+	workers sync.WaitGroup
+}
+
+func newWorkerPool(workers, queueSize int, handle func(ClientRequest)) *workerPool {
+	p := &workerPool{queues: make([]chan ClientRequest, workers), handle: handle}
+	for i := range p.queues {
+		p.queues[i] = make(chan ClientRequest, queueSize)
+		p.workers.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *workerPool) work(queue <-chan ClientRequest) {
+	defer p.workers.Done()
+	for req := range queue {
+		metrics.clientRequestQueue.Set(float64(p.queued.Add(-1)))
+		p.handle(req)
+	}
+}
+
+// Queues a request, waiting for room on the client's worker if necessary.
+// Must not be called after stop.
+func (p *workerPool) submit(req ClientRequest) {
+	queue := p.queues[p.workerFor(req.c)]
+	metrics.clientRequestQueue.Set(float64(p.queued.Add(1)))
+	select {
+	case queue <- req:
+	default:
+		metrics.clientRequestsThrottled.Inc()
+		queue <- req
+	}
+}
+
+func (p *workerPool) workerFor(c *Client) int {
+	h := fnv.New32a()
+	h.Write([]byte(c.id))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// Lets the workers finish the queued requests and exit. Returns a channel
+// which is closed once they're done.
+func (p *workerPool) stop() <-chan struct{} {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+	return done
+}
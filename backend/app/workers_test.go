@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolKeepsClientOrder(t *testing.T) {
+	var mu sync.Mutex
+	seen := make(map[*Client][]int)
+	pool := newWorkerPool(4, 2, func(req ClientRequest) {
+		var n int
+		fmt.Sscan(req.request.Type, &n)
+		mu.Lock()
+		seen[req.c] = append(seen[req.c], n)
+		mu.Unlock()
+	})
+
+	clients := make([]*Client, 10)
+	var wg sync.WaitGroup
+	for i := range clients {
+		clients[i] = &Client{id: newId()}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range 100 {
+				pool.submit(ClientRequest{c: clients[i], request: &SocketEvent{Type: fmt.Sprint(n)}})
+			}
+		}()
+	}
+	wg.Wait()
+	<-pool.stop()
+
+	for i, c := range clients {
+		if len(seen[c]) != 100 {
+			t.Fatalf("client %d: got %d requests, want 100", i, len(seen[c]))
+		}
+		for n, got := range seen[c] {
+			if got != n {
+				t.Fatalf("client %d: request %d handled as number %d", i, n, got)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolBlocksWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	pool := newWorkerPool(1, 1, func(ClientRequest) { <-release })
+	c := &Client{id: newId()}
+
+	submitted := make(chan struct{})
+	go func() {
+		for range 3 { // one being handled, one queued, one waiting
+			pool.submit(ClientRequest{c: c, request: &SocketEvent{}})
+		}
+		close(submitted)
+	}()
+
+	select {
+	case <-submitted:
+		t.Fatal("submit didn't block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-submitted
+	<-pool.stop()
+}